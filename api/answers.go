@@ -0,0 +1,85 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"mosdns-log/service"
+)
+
+type resolvedDomain struct {
+	QName    string    `json:"q_name"`
+	Count    int64     `json:"count"`
+	Clients  int64     `json:"clients"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// GetReverse 按应答中的 IP 地址或 CIDR 网段反查解析到该地址的域名
+func (h *Handler) GetReverse(c *gin.Context) {
+	ip := c.Query("ip")
+	if ip == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ip is required"})
+		return
+	}
+	loc, ok := viewerLocation(c)
+	if !ok {
+		return
+	}
+	lo, hi, err := service.AnswerIPRange(ip)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	limit := 100
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 {
+		limit = min(l, 1000)
+	}
+
+	query := h.logs(c).
+		Select("q_name, COUNT(*) AS count, COUNT(DISTINCT client_ip) AS clients, MAX(time) AS last_seen").
+		Where("id IN (SELECT query_id FROM query_answers WHERE ip_key BETWEEN ? AND ?)", lo, hi)
+	if start := c.Query("start_time"); start != "" {
+		if t, ok := parseQueryTime(start, loc); ok {
+			query = query.Where("datetime(time) >= datetime(?)", t)
+		}
+	}
+	if end := c.Query("end_time"); end != "" {
+		if t, ok := parseQueryTime(end, loc); ok {
+			query = query.Where("datetime(time) <= datetime(?)", t)
+		}
+	}
+
+	rows, err := query.Group("q_name").Order("count DESC").Limit(limit).Rows()
+	if err != nil {
+		slog.Error("Error looking up answers", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	domains := make([]resolvedDomain, 0)
+	for rows.Next() {
+		var (
+			d        resolvedDomain
+			lastSeen string
+		)
+		if err := rows.Scan(&d.QName, &d.Count, &d.Clients, &lastSeen); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		d.LastSeen, _ = time.Parse(service.SQLiteTimeLayout, lastSeen)
+		if loc != nil {
+			d.LastSeen = d.LastSeen.In(loc)
+		}
+		domains = append(domains, d)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ip":      ip,
+		"domains": domains,
+	})
+}
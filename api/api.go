@@ -2,6 +2,7 @@ package api
 
 import (
 	"database/sql"
+	"errors"
 	"log/slog"
 	"net/http"
 	"strconv"
@@ -10,22 +11,44 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"mosdns-log/config"
 	"mosdns-log/model"
+	"mosdns-log/service"
 )
 
 type Handler struct {
 	db             *gorm.DB
+	conf           *config.Config
+	collector      *service.Collector
+	importer       *service.Importer
+	cleaner        *service.Cleaner
+	rollups        *service.Rollups
 
-	statsCache     gin.H
-	statsCacheTime time.Time
+	statsCache     map[string]gin.H
+	statsCacheTime map[string]time.Time
 	statsMutex     sync.Mutex
 }
 
-func NewHandler(db *gorm.DB) *Handler {
+func NewHandler(db *gorm.DB, conf *config.Config, collector *service.Collector, importer *service.Importer, cleaner *service.Cleaner) *Handler {
 	return &Handler{
-		db:       db,
+		db:             db,
+		conf:           conf,
+		collector:      collector,
+		importer:       importer,
+		cleaner:        cleaner,
+		rollups:        service.NewRollups(db, conf),
+		statsCache:     make(map[string]gin.H),
+		statsCacheTime: make(map[string]time.Time),
+	}
+}
 
+// logs 返回 query_logs 查询，并按 source 参数限定日志来源（留空表示全部来源）
+func (h *Handler) logs(c *gin.Context) *gorm.DB {
+	q := h.db.Model(&model.QueryLog{})
+	if src := c.Query("source"); src != "" {
+		q = q.Where("source = ?", src)
 	}
+	return q
 }
 
 func (h *Handler) RegisterRoutes(r *gin.Engine) {
@@ -39,10 +62,24 @@ func (h *Handler) RegisterRoutes(r *gin.Engine) {
 
 	{
 		api.GET("/stats", h.GetStats)
+		api.GET("/stats/series", h.GetStatsSeries)
+		api.GET("/stats/top", h.GetStatsTop)
+		api.GET("/domains/tree", h.GetDomainTree)
 		api.GET("/logs", h.GetLogs)
 		api.GET("/clients", h.GetClients)
 		api.GET("/qtypes", h.GetQTypes)
 		api.GET("/rcodes", h.GetRCodes)
+		api.GET("/protocols", h.GetProtocols)
+		api.GET("/servers", h.GetServerNames)
+		api.GET("/sources", h.GetSources)
+		api.GET("/reverse", h.GetReverse)
+		api.GET("/collector/errors", h.GetCollectorErrors)
+		api.GET("/collector/status", h.GetCollectorStatus)
+		api.GET("/collector/rules", h.GetCollectorRules)
+		api.GET("/db/retention", h.GetRetentionStatus)
+		api.GET("/import", h.GetImport)
+		api.POST("/import", h.requireIngestToken, h.PostImport)
+		api.POST("/ingest", h.requireIngestToken, h.PostIngest)
 
 	}
 }
@@ -50,7 +87,7 @@ func (h *Handler) RegisterRoutes(r *gin.Engine) {
 func (h *Handler) GetClients(c *gin.Context) {
 	var clients []string
 	// Get all unique client IPs
-	h.db.Model(&model.QueryLog{}).
+	h.logs(c).
 		Distinct("client_ip").
 		Pluck("client_ip", &clients)
 	c.JSON(http.StatusOK, clients)
@@ -58,7 +95,7 @@ func (h *Handler) GetClients(c *gin.Context) {
 
 func (h *Handler) GetQTypes(c *gin.Context) {
 	var types []int
-	h.db.Model(&model.QueryLog{}).
+	h.logs(c).
 		Distinct("q_type").
 		Order("q_type").
 		Pluck("q_type", &types)
@@ -67,21 +104,84 @@ func (h *Handler) GetQTypes(c *gin.Context) {
 
 func (h *Handler) GetRCodes(c *gin.Context) {
 	var rcodes []int
-	h.db.Model(&model.QueryLog{}).
+	h.logs(c).
 		Distinct("r_code").
 		Order("r_code").
 		Pluck("r_code", &rcodes)
 	c.JSON(http.StatusOK, rcodes)
 }
 
+func (h *Handler) GetSources(c *gin.Context) {
+	var sources []string
+	h.db.Model(&model.QueryLog{}).
+		Distinct("source").
+		Order("source").
+		Pluck("source", &sources)
+	c.JSON(http.StatusOK, sources)
+}
+
+func (h *Handler) GetProtocols(c *gin.Context) {
+	var protocols []string
+	h.logs(c).
+		Distinct("protocol").
+		Order("protocol").
+		Pluck("protocol", &protocols)
+	c.JSON(http.StatusOK, protocols)
+}
+
+func (h *Handler) GetServerNames(c *gin.Context) {
+	var servers []string
+	h.logs(c).
+		Distinct("server_name").
+		Order("server_name").
+		Pluck("server_name", &servers)
+	c.JSON(http.StatusOK, servers)
+}
+
+
+
+// GetImport 返回当前（或最近一次）导入任务的进度
+func (h *Handler) GetImport(c *gin.Context) {
+	c.JSON(http.StatusOK, h.importer.Progress())
+}
+
+type importRequest struct {
+	Paths       []string `json:"paths" binding:"required,min=1"`
+	Source      string   `json:"source" binding:"required"`
+	Format      string   `json:"format"`
+	TimeLayouts []string `json:"time_layouts"`
+	Timezone    string   `json:"timezone"`
+}
 
+// PostImport 在后台导入服务器上的历史日志文件（支持通配符、.gz / .zst 压缩及不同日志格式）。
+// 接口可以读取服务器上的任意文件，与推送接口一样需要 ingest_token
+func (h *Handler) PostImport(c *gin.Context) {
+	var req importRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	opts := service.ParserOptions{TimeLayouts: req.TimeLayouts, Timezone: req.Timezone}
+	err := h.importer.Start(req.Paths, req.Source, req.Format, opts)
+	if errors.Is(err, service.ErrImportRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, h.importer.Progress())
+}
 
 func (h *Handler) GetStats(c *gin.Context) {
 	h.statsMutex.Lock()
 	defer h.statsMutex.Unlock()
 
-	if time.Since(h.statsCacheTime) < 60*time.Second && h.statsCache != nil {
-		c.JSON(http.StatusOK, h.statsCache)
+	source := c.Query("source")
+	if cached, ok := h.statsCache[source]; ok && time.Since(h.statsCacheTime[source]) < 60*time.Second {
+		c.JSON(http.StatusOK, cached)
 		return
 	}
 
@@ -91,7 +191,7 @@ func (h *Handler) GetStats(c *gin.Context) {
 
 	getLatency := func(since time.Time, minLatencyMicros int64) float64 {
 		var avg sql.NullFloat64
-		q := h.db.Model(&model.QueryLog{}).
+		q := h.logs(c).
 			Select("AVG(elapsed)").
 			Where("time > ?", since)
 			
@@ -117,14 +217,19 @@ func (h *Handler) GetStats(c *gin.Context) {
 		"upstream_avg_latency_7d": getLatency(sevenDaysAgo, 1000),
 	}
 
-	h.statsCache = result
-	h.statsCacheTime = time.Now()
+	h.statsCache[source] = result
+	h.statsCacheTime[source] = time.Now()
 
 	c.JSON(http.StatusOK, result)
 }
 
 func (h *Handler) GetLogs(c *gin.Context) {
 	var logs []model.QueryLog
+
+	loc, ok := viewerLocation(c)
+	if !ok {
+		return
+	}
 	
 	// Pagination
 	page := 1
@@ -142,8 +247,8 @@ func (h *Handler) GetLogs(c *gin.Context) {
 		}
 	}
 	
-	// Filter
-	query := h.db.Model(&model.QueryLog{})
+	// Filter (scoped to source)
+	query := h.logs(c)
 	
 	// 1. Type Filter
 	if t := c.Query("type"); t != "" {
@@ -152,9 +257,15 @@ func (h *Handler) GetLogs(c *gin.Context) {
 
 	// 2. Search (Domain or IP)
 	if q := c.Query("search"); q != "" {
-		query = query.Where("q_name LIKE ? OR client_ip LIKE ?", "%"+q+"%", "%"+q+"%")
+		cond, args := service.LogSearchSQL(q, h.conf.SearchIndex)
+		query = query.Where(cond, args...)
 	}
 	
+	// 可注册域名（eTLD+1）过滤，命中 base_domain 索引，如 googlevideo.com 匹配其所有子域名
+	if bd := c.Query("base_domain"); bd != "" {
+		query = query.Where("base_domain = ?", service.BaseDomain(bd))
+	}
+
 	// 3. Exact Client IP Filter
 	if ip := c.Query("client_ip"); ip != "" {
 		query = query.Where("client_ip = ?", ip)
@@ -165,38 +276,76 @@ func (h *Handler) GetLogs(c *gin.Context) {
 		query = query.Where("r_code = ?", rc)
 	}
 
-	// 5. Time Range
+	// 5. Protocol / Listener Filter
+	if proto := c.Query("protocol"); proto != "" {
+		query = query.Where("protocol = ?", proto)
+	}
+	if sn := c.Query("server_name"); sn != "" {
+		query = query.Where("server_name = ?", sn)
+	}
+	if qc := c.Query("q_class"); qc != "" {
+		query = query.Where("q_class = ?", qc)
+	}
+	if id := c.Query("uqid"); id != "" {
+		query = query.Where("uqid = ?", id)
+	}
+
+	// 6. Time Range
 	if start := c.Query("start_time"); start != "" {
-		if t, err := time.Parse(time.RFC3339, start); err == nil {
+		if t, ok := parseQueryTime(start, loc); ok {
 			query = query.Where("datetime(time) >= datetime(?)", t)
 		}
 	}
 	if end := c.Query("end_time"); end != "" {
-		if t, err := time.Parse(time.RFC3339, end); err == nil {
+		if t, ok := parseQueryTime(end, loc); ok {
 			query = query.Where("datetime(time) <= datetime(?)", t)
 		}
 	}
 
-	// 6. Sorting
+	// 7. Sorting
 	sort := c.Query("sort")
-	switch sort {
-	case "latency_desc":
-		query = query.Order("elapsed desc")
-	case "latency_asc":
-		query = query.Order("elapsed asc")
-	case "time_asc":
-		query = query.Order("time asc")
-	default:
-		query = query.Order("time desc") // Default
-	}
-
-	// Count Total
-	var total int64
-	query.Count(&total)
-	
-	// Fetch Page
-	result := query.Limit(pageSize).
-		Offset((page - 1) * pageSize).
+	if _, ok := logSorts[sort]; !ok {
+		sort = "time_desc" // Default
+	}
+	order := logSorts[sort]
+
+	// 8. Snapshot: 游标翻页只返回第一页查询时已写入的记录，翻页期间新写入的记录不影响结果与总数
+	var cursor *logCursor
+	if s := c.Query("cursor"); s != "" {
+		cur, err := decodeLogCursor(s, sort)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		cursor = cur
+	} else {
+		cursor = &logCursor{Sort: sort}
+		if err := h.db.Model(&model.QueryLog{}).Select("COALESCE(MAX(id), 0)").Scan(&cursor.Snapshot).Error; err != nil {
+			slog.Error("Error fetching logs", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	query = query.Where("id <= ?", cursor.Snapshot)
+
+	// Count Total (total=exact|estimate|none)
+	total, estimated, counted, err := countLogs(h.db, query, c.Query("total"))
+	if err != nil {
+		slog.Error("Error counting logs", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Fetch Page: 带 cursor 时从上一页最后一条之后继续（keyset），否则按 page 偏移。多取一条判断是否还有下一页
+	if cursor.ID != 0 {
+		cond, args := order.after(cursor)
+		query = query.Where(cond, args...)
+	} else {
+		query = query.Offset((page - 1) * pageSize)
+	}
+	result := query.Order(order.order()).
+		Limit(pageSize + 1).
+		Preload("Answers").
 		Find(&logs)
 		
 	if result.Error != nil {
@@ -204,11 +353,35 @@ func (h *Handler) GetLogs(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
 		return
 	}
+
+	nextCursor := ""
+	if len(logs) > pageSize {
+		logs = logs[:pageSize]
+		last := logs[pageSize-1]
+		nextCursor, err = nextLogCursor(h.db, sort, order, last.ID, last.Elapsed, cursor.Snapshot)
+		if err != nil {
+			slog.Error("Error fetching logs", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// Render times in the viewer's zone
+	if loc != nil {
+		for i := range logs {
+			logs[i].Time = logs[i].Time.In(loc)
+		}
+	}
 		
-	c.JSON(http.StatusOK, gin.H{
+	resp := gin.H{
 		"logs":  logs,
-		"total": total,
 		"page":  page,
 		"page_size": pageSize,
-	})
+		"next_cursor": nextCursor,
+	}
+	if counted {
+		resp["total"] = total
+		resp["total_estimated"] = estimated
+	}
+	c.JSON(http.StatusOK, resp)
 }
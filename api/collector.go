@@ -0,0 +1,53 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"mosdns-log/model"
+)
+
+// GetCollectorErrors 返回解析失败的统计，以及 parse_errors 表中最近隔离的原始行
+func (h *Handler) GetCollectorErrors(c *gin.Context) {
+	limit := 50
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 {
+		limit = min(l, 500)
+	}
+
+	query := h.db.Model(&model.ParseError{})
+	if src := c.Query("source"); src != "" {
+		query = query.Where("source = ?", src)
+	}
+	if reason := c.Query("reason"); reason != "" {
+		query = query.Where("reason = ?", reason)
+	}
+
+	recent := make([]model.ParseError, 0)
+	if err := query.Order("id desc").Limit(limit).Find(&recent).Error; err != nil {
+		slog.Error("Error fetching parse errors", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"stats":  h.collector.ParseErrorStats(),
+		"recent": recent,
+	})
+}
+
+// GetCollectorStatus 返回采集器的吞吐计数、队列深度、最近写入延迟与各日志文件的读取进度
+func (h *Handler) GetCollectorStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, h.collector.Status())
+}
+
+// GetCollectorRules 返回各条 ingest_rules 的命中、丢弃与抽样保留计数
+func (h *Handler) GetCollectorRules(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"rules": h.collector.IngestRuleStats()})
+}
+
+// GetRetentionStatus 返回保留策略、当前数据库大小，以及按时间和按空间上限清理的最近结果
+func (h *Handler) GetRetentionStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, h.cleaner.RetentionStatus())
+}
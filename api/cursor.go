@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// estimateTotalCap total=estimate 时最多计数的记录数，超过时只返回该值并标记 total_estimated
+const estimateTotalCap = 10000
+
+// logSort 是 /api/logs 的一种排序方式，相同值按 id 排序，保证顺序唯一
+type logSort struct {
+	column string
+	desc   bool
+}
+
+var logSorts = map[string]logSort{
+	"time_desc":    {"time", true},
+	"time_asc":     {"time", false},
+	"latency_desc": {"elapsed", true},
+	"latency_asc":  {"elapsed", false},
+}
+
+func (s logSort) order() string {
+	if s.desc {
+		return s.column + " desc, id desc"
+	}
+	return s.column + " asc, id asc"
+}
+
+// after 返回排在游标所指记录之后的条件，(column, id) 行值比较可以使用 column 上的索引
+func (s logSort) after(cur *logCursor) (string, []interface{}) {
+	op := ">"
+	if s.desc {
+		op = "<"
+	}
+	var value interface{} = cur.Value
+	if s.column == "elapsed" {
+		v, _ := strconv.ParseInt(cur.Value, 10, 64)
+		value = v
+	}
+	return "(" + s.column + ", id) " + op + " (?, ?)", []interface{}{value, cur.ID}
+}
+
+// logCursor 是 /api/logs 分页游标的内容，编码后对客户端不透明。
+// Snapshot 为第一页查询时的最大 id，之后的页只返回不超过它的记录，翻页期间新写入的记录不会插入结果中。
+type logCursor struct {
+	Sort     string `json:"s"`
+	Value    string `json:"v"` // 上一页最后一条记录的排序列：time 为存储的文本，elapsed 为十进制整数
+	ID       uint   `json:"id"`
+	Snapshot uint   `json:"snap"`
+}
+
+func (cur *logCursor) encode() string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeLogCursor(s, sort string) (*logCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var cur logCursor
+	if err := json.Unmarshal(b, &cur); err != nil || cur.Snapshot == 0 {
+		return nil, errors.New("invalid cursor")
+	}
+	if cur.Sort != sort {
+		return nil, errors.New("cursor was created with a different sort")
+	}
+	return &cur, nil
+}
+
+// nextLogCursor 为 last 之后的一页生成游标。time 按存储的文本排序，从数据库读取原文以免格式化误差；
+// 驱动会把 datetime 列解析为 time.Time 再格式化，因此用 CAST 取出未经转换的文本。
+func nextLogCursor(db *gorm.DB, sort string, s logSort, lastID uint, elapsed int64, snapshot uint) (string, error) {
+	cur := &logCursor{Sort: sort, ID: lastID, Snapshot: snapshot}
+	if s.column == "elapsed" {
+		cur.Value = strconv.FormatInt(elapsed, 10)
+	} else if err := db.Raw("SELECT CAST(time AS TEXT) FROM query_logs WHERE id = ?", lastID).Scan(&cur.Value).Error; err != nil {
+		return "", err
+	}
+	return cur.encode(), nil
+}
+
+// countLogs 按 total 参数统计符合条件的记录数：exact 精确计数；estimate 最多计数 estimateTotalCap 条，
+// 超过时返回 estimateTotalCap 且 estimated 为 true；none 不计数（counted 为 false）
+func countLogs(db, query *gorm.DB, mode string) (total int64, estimated, counted bool, err error) {
+	switch mode {
+	case "none":
+		return 0, false, false, nil
+	case "estimate":
+		sub := query.Session(&gorm.Session{}).Select("id").Limit(estimateTotalCap + 1)
+		err = db.Raw("SELECT COUNT(*) FROM (?)", sub).Scan(&total).Error
+		if total > estimateTotalCap {
+			return estimateTotalCap, true, true, err
+		}
+		return total, false, true, err
+	default:
+		err = query.Session(&gorm.Session{}).Count(&total).Error
+		return total, false, true, err
+	}
+}
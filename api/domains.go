@@ -0,0 +1,35 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"mosdns-log/service"
+)
+
+// GetDomainTree 返回 parent 下一级域名的查询次数（parent 为空时为顶级域名），用于逐级下钻：
+// com → example.com → www.example.com。时间范围与来源参数同 /api/stats/top，只统计原始记录。
+func (h *Handler) GetDomainTree(c *gin.Context) {
+	loc, ok := viewerLocation(c)
+	if !ok {
+		return
+	}
+	q, ok := h.rollupQuery(c, loc)
+	if !ok {
+		return
+	}
+	limit := 50
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 {
+		limit = min(l, 500)
+	}
+
+	tree, err := service.QueryDomainTree(h.db, q, c.Query("parent"), limit)
+	if err != nil {
+		slog.Error("Error fetching domain tree", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, tree)
+}
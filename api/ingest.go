@@ -0,0 +1,108 @@
+package api
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"mosdns-log/model"
+	"mosdns-log/service"
+)
+
+const (
+	maxIngestBodyBytes = 8 << 20 // 单次推送的最大请求体
+	maxIngestLineBytes = 64 << 10
+	maxIngestErrors    = 20 // 响应中最多返回的错误明细条数
+	defaultIngestSrc   = "push"
+)
+
+// requireIngestToken 校验 Authorization: Bearer <ingest_token>，未配置 token 时接口不可用
+func (h *Handler) requireIngestToken(c *gin.Context) {
+	token := h.conf.IngestToken
+	if token == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "ingest is disabled: ingest_token is not configured"})
+		return
+	}
+	got, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or missing bearer token"})
+		return
+	}
+	c.Next()
+}
+
+type ingestError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// PostIngest 接收 NDJSON 推送：每行是 mosdns 原始日志行或 LogPayload 形式的 JSON 对象。
+// 整批校验后一次性送入采集队列，队列已满时返回 429，调用方应重试整批。
+// 被 ingest_rules 丢弃的行计入 filtered，不视为错误。
+func (h *Handler) PostIngest(c *gin.Context) {
+	source := c.Query("source")
+	if source == "" {
+		source = defaultIngestSrc
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxIngestBodyBytes)
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 4096), maxIngestLineBytes)
+
+	var (
+		rows     []*model.QueryLog
+		rejected int
+		filtered int
+		errs     []ingestError
+	)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		ql, err := h.collector.ParseIngestLine(line, source)
+		if err != nil {
+			rejected++
+			if len(errs) < maxIngestErrors {
+				errs = append(errs, ingestError{Line: lineNo, Error: err.Error()})
+			}
+			continue
+		}
+		if ql == nil {
+			filtered++
+			continue
+		}
+		rows = append(rows, ql)
+	}
+	if err := scanner.Err(); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "line": lineNo + 1})
+		return
+	}
+
+	switch err := h.collector.Ingest(rows); {
+	case errors.Is(err, service.ErrBackpressure):
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error(), "accepted": 0, "rejected": rejected})
+		return
+	case err != nil:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"accepted": len(rows),
+		"rejected": rejected,
+		"filtered": filtered,
+		"errors":   errs,
+	})
+}
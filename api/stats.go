@@ -0,0 +1,105 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"mosdns-log/model"
+	"mosdns-log/service"
+)
+
+// rollupQuery 解析 start_time、end_time 与 source，缺省为最近 24 小时。
+// 参数无效时写入 400 响应并返回 false。
+func (h *Handler) rollupQuery(c *gin.Context, loc *time.Location) (service.RollupQuery, bool) {
+	now := time.Now()
+	q := service.RollupQuery{Start: now.Add(-24 * time.Hour), End: now, Source: c.Query("source")}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"start_time", &q.Start}, {"end_time", &q.End}} {
+		s := c.Query(p.name)
+		if s == "" {
+			continue
+		}
+		t, ok := parseQueryTime(s, loc)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + p.name})
+			return q, false
+		}
+		*p.dst = t
+	}
+	if !q.Start.Before(q.End) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "start_time must be before end_time"})
+		return q, false
+	}
+	return q, true
+}
+
+// GetStatsSeries 返回每小时或每天（interval=day）的查询次数、平均延迟与延迟直方图。
+// 超出原始记录保留期的部分自动读取聚合表。
+func (h *Handler) GetStatsSeries(c *gin.Context) {
+	loc, ok := viewerLocation(c)
+	if !ok {
+		return
+	}
+	q, ok := h.rollupQuery(c, loc)
+	if !ok {
+		return
+	}
+	interval := c.DefaultQuery("interval", "hour")
+	if interval != "hour" && interval != "day" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "interval must be hour or day"})
+		return
+	}
+
+	points, err := h.rollups.Series(q, interval == "day", loc)
+	if err != nil {
+		slog.Error("Error fetching stats series", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	bounds := make([]float64, len(model.RollupLatencyBounds))
+	for i, b := range model.RollupLatencyBounds {
+		bounds[i] = float64(b) / 1000
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"interval":            interval,
+		"histogram_bounds_ms": bounds,
+		"points":              points,
+	})
+}
+
+// GetStatsTop 返回某个维度（domain、client、qtype、rcode）查询次数最多的项
+func (h *Handler) GetStatsTop(c *gin.Context) {
+	loc, ok := viewerLocation(c)
+	if !ok {
+		return
+	}
+	q, ok := h.rollupQuery(c, loc)
+	if !ok {
+		return
+	}
+	limit := 10
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 {
+		limit = min(l, 100)
+	}
+	dim := c.DefaultQuery("dim", service.RollupDomain)
+	switch dim {
+	case service.RollupDomain, service.RollupClient, service.RollupQType, service.RollupRCode:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "dim must be domain, client, qtype or rcode"})
+		return
+	}
+
+	top, err := h.rollups.Top(q, dim, limit)
+	if err != nil {
+		slog.Error("Error fetching top stats", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"dim": dim, "items": top})
+}
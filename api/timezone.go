@@ -0,0 +1,39 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// queryTimeLayouts 是 start_time / end_time 接受的格式，不带时区的按 tz 参数解释
+var queryTimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04"}
+
+// viewerLocation 解析 tz 参数（IANA 时区名），未指定时返回 nil，结果保持存储时的时区。
+// 时区无效时写入 400 响应并返回 false。
+func viewerLocation(c *gin.Context) (*time.Location, bool) {
+	tz := c.Query("tz")
+	if tz == "" {
+		return nil, true
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid tz: " + err.Error()})
+		return nil, false
+	}
+	return loc, true
+}
+
+// parseQueryTime 解析时间范围参数，loc 为 nil 时不带时区的时间按本地时区解释
+func parseQueryTime(s string, loc *time.Location) (time.Time, bool) {
+	if loc == nil {
+		loc = time.Local
+	}
+	for _, layout := range queryTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -1,33 +1,130 @@
 package config
 
 import (
+	"fmt"
 	"os"
 
 	"gopkg.in/yaml.v3"
 )
 
+// LogSource 描述一个 DNS 服务实例的日志文件，Format 为空时按 mosdns-x 格式解析。
+// 未设置的 Format、TimeLayouts、Timezone、StartFrom 使用顶层的 log_format 等配置。
+type LogSource struct {
+	Name        string   `yaml:"name"`
+	Path        string   `yaml:"path"`
+	Format      string   `yaml:"format"`
+	TimeLayouts []string `yaml:"time_layouts"`
+	Timezone    string   `yaml:"timezone"`
+	StartFrom   string   `yaml:"start_from"` // beginning、end、checkpoint 或时间戳
+}
+
+// 启动时的读取位置，start_from 的其他值按时间戳解析
+const (
+	StartBeginning  = "beginning"  // 从文件开头读取
+	StartEnd        = "end"        // 只读取启动后追加的内容
+	StartCheckpoint = "checkpoint" // 从断点继续，没有有效断点时从开头读取
+)
+
+// SyslogConfig 配置 syslog 接收端，Listen 为空时不启用
+type SyslogConfig struct {
+	Listen      string   `yaml:"listen"`
+	Network     string   `yaml:"network"` // udp、tcp 或 both（默认）
+	Format      string   `yaml:"format"`
+	TimeLayouts []string `yaml:"time_layouts"`
+	Timezone    string   `yaml:"timezone"`
+}
+
+// IngestRule 是一条入库过滤规则：所有已配置的条件都满足时命中，同一条件的列表中任一项匹配即可。
+// 记录按规则顺序匹配，由第一条命中的规则决定丢弃或抽样保留。
+type IngestRule struct {
+	Name        string   `yaml:"name"`
+	Action      string   `yaml:"action"` // drop（默认）或 sample
+	Sample      int      `yaml:"sample"` // sample 时每 N 条保留 1 条
+	Sources     []string `yaml:"sources"`
+	Clients     []string `yaml:"clients"` // IP 或 CIDR
+	Domains     []string `yaml:"domains"` // 域名后缀，同时匹配域名本身
+	DomainRegex string   `yaml:"domain_regex"`
+	QTypes      []string `yaml:"qtypes"` // 类型名或数值，如 A、PTR、65
+	RCodes      []string `yaml:"rcodes"` // 响应码名或数值，如 NXDOMAIN、2
+}
+
+// 入库过滤规则的动作
+const (
+	RuleDrop   = "drop"
+	RuleSample = "sample"
+)
+
+// DnstapConfig 配置 dnstap（Frame Streams）接收端，Listen 为空时不启用
+type DnstapConfig struct {
+	Listen  string `yaml:"listen"`  // unix 套接字路径或 TCP 地址
+	Network string `yaml:"network"` // unix（默认）或 tcp
+}
+
 type Config struct {
-	LogPath             string `yaml:"log_path"`
-	DBRetentionDays     int    `yaml:"db_retention_days"`
-	LogMaxSizeMB        int64  `yaml:"log_max_size_mb"`
-	LogCheckIntervalMin int    `yaml:"log_check_interval_mins"`
-	DBCheckIntervalMin  int    `yaml:"db_check_interval_mins"`
-	Port                string `yaml:"port"`
-	AppLogPath          string `yaml:"app_log_path"`
-	AppLogLevel         string `yaml:"app_log_level"`
+	LogPath              string       `yaml:"log_path"`
+	LogFormat            string       `yaml:"log_format"`
+	LogTimeLayouts       []string     `yaml:"log_time_layouts"`
+	LogTimezone          string       `yaml:"log_timezone"`
+	LogStartFrom         string       `yaml:"log_start_from"`
+	LogSources           []LogSource  `yaml:"log_sources"`
+	DBRetentionDays      int          `yaml:"db_retention_days"`
+	DBMaxSizeMB          int          `yaml:"db_max_size_mb"` // 0 表示不限制
+	LogMaxSizeMB         int64        `yaml:"log_max_size_mb"`
+	LogCheckIntervalMin  int          `yaml:"log_check_interval_mins"`
+	LogRotateMode        string       `yaml:"log_rotate_mode"`
+	LogArchiveKeep       int          `yaml:"log_archive_keep"`
+	LogArchiveMaxAgeDays int          `yaml:"log_archive_max_age_days"`
+	DBCheckIntervalMin   int          `yaml:"db_check_interval_mins"`
+	RollupHourlyDays     int          `yaml:"rollup_hourly_days"` // 0 表示不生成聚合统计
+	RollupDailyDays      int          `yaml:"rollup_daily_days"`
+	Port                 string       `yaml:"port"`
+	AppLogPath           string       `yaml:"app_log_path"`
+	AppLogLevel          string       `yaml:"app_log_level"`
+	DBPersist            bool         `yaml:"db_persist"`
+	DBPath               string       `yaml:"db_path"`
+	DBMode               string       `yaml:"db_mode"`
+	MemoryMaxRows        int          `yaml:"memory_max_rows"`
+	MemoryMaxSizeMB      int          `yaml:"memory_max_size_mb"`
+	SearchIndex          bool         `yaml:"search_index"` // 为 q_name、client_ip 建立 FTS5 trigram 索引
+	Syslog               SyslogConfig `yaml:"syslog"`
+	Dnstap               DnstapConfig `yaml:"dnstap"`
+	IngestToken          string       `yaml:"ingest_token"`
+	ParseErrorsKeep      int          `yaml:"parse_errors_keep"`
+	SpoolPath            string       `yaml:"spool_path"`
+	SpoolMaxSizeMB       int          `yaml:"spool_max_size_mb"`
+	BatchSize            int          `yaml:"batch_size"`
+	FlushIntervalMs      int          `yaml:"flush_interval_ms"`
+	ParseWorkers         int          `yaml:"parse_workers"` // 0 表示按 CPU 核数自动选择
+	IngestRules          []IngestRule `yaml:"ingest_rules"`
 }
 
 func LoadConfig(path string) (*Config, error) {
 	// Defaults
 	cfg := &Config{
-		LogPath:             "mosdns.log",
-		DBRetentionDays:     7,
-		LogMaxSizeMB:        50,
-		LogCheckIntervalMin: 60, // Default 1 hour
-		DBCheckIntervalMin:  60, // Default 1 hour
-		Port:                "8080",
-		AppLogPath:          "",     // Default to empty (stdout)
-		AppLogLevel:         "INFO", // Default to INFO
+		LogPath:              "mosdns.log",
+		LogStartFrom:         StartCheckpoint,
+		DBRetentionDays:      7,
+		LogMaxSizeMB:         50,
+		LogCheckIntervalMin:  60, // Default 1 hour
+		LogRotateMode:        RotateTruncate,
+		LogArchiveKeep:       5,
+		LogArchiveMaxAgeDays: 30,
+		DBCheckIntervalMin:   60, // Default 1 hour
+		RollupHourlyDays:     90,
+		RollupDailyDays:      730,
+		Port:                 "8080",
+		AppLogPath:           "",     // Default to empty (stdout)
+		AppLogLevel:          "INFO", // Default to INFO
+		DBPersist:            false,  // Default to fresh database on every start
+		DBPath:               "mosdns.db",
+		DBMode:               DBModeFile,
+		MemoryMaxRows:        200000,
+		SearchIndex:          true,
+		ParseErrorsKeep:      1000,
+		SpoolPath:            "mosdns.spool",
+		SpoolMaxSizeMB:       256,
+		BatchSize:            500,
+		FlushIntervalMs:      3000,
 	}
 
 	file, err := os.Open(path)
@@ -44,5 +141,130 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if err := cfg.normalizeSources(); err != nil {
+		return nil, err
+	}
+
+	switch cfg.Syslog.Network {
+	case "", "both", "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("unknown syslog.network %q", cfg.Syslog.Network)
+	}
+
+	switch cfg.Dnstap.Network {
+	case "", "unix", "tcp":
+	default:
+		return nil, fmt.Errorf("unknown dnstap.network %q", cfg.Dnstap.Network)
+	}
+
+	if cfg.BatchSize <= 0 {
+		return nil, fmt.Errorf("batch_size must be positive, got %d", cfg.BatchSize)
+	}
+	if cfg.FlushIntervalMs <= 0 {
+		return nil, fmt.Errorf("flush_interval_ms must be positive, got %d", cfg.FlushIntervalMs)
+	}
+	if cfg.RollupHourlyDays < 0 || cfg.RollupDailyDays < 0 {
+		return nil, fmt.Errorf("rollup_hourly_days and rollup_daily_days must not be negative")
+	}
+	if cfg.ParseWorkers < 0 {
+		return nil, fmt.Errorf("parse_workers must not be negative, got %d", cfg.ParseWorkers)
+	}
+
+	switch cfg.DBMode {
+	case DBModeFile:
+		if cfg.DBPath == "" {
+			return nil, fmt.Errorf("db_path must not be empty")
+		}
+		if cfg.DBMaxSizeMB < 0 {
+			return nil, fmt.Errorf("db_max_size_mb must not be negative, got %d", cfg.DBMaxSizeMB)
+		}
+	case DBModeMemory:
+		if cfg.MemoryMaxRows < 0 || cfg.MemoryMaxSizeMB < 0 {
+			return nil, fmt.Errorf("memory_max_rows and memory_max_size_mb must not be negative")
+		}
+		if cfg.MemoryMaxRows == 0 && cfg.MemoryMaxSizeMB == 0 {
+			return nil, fmt.Errorf("db_mode memory requires memory_max_rows or memory_max_size_mb")
+		}
+		// 内存数据库在进程退出后即丢失，断点与 spool 没有意义，也避免写入闪存
+		cfg.DBPersist = false
+		cfg.SpoolPath = ""
+	default:
+		return nil, fmt.Errorf("unknown db_mode %q", cfg.DBMode)
+	}
+
+	switch cfg.LogRotateMode {
+	case RotateTruncate, RotateArchive:
+	case "":
+		cfg.LogRotateMode = RotateTruncate
+	default:
+		return nil, fmt.Errorf("unknown log_rotate_mode %q", cfg.LogRotateMode)
+	}
+
 	return cfg, nil
 }
+
+// 日志轮转模式
+const (
+	RotateTruncate = "truncate" // 入库后直接清空
+	RotateArchive  = "archive"  // 入库后压缩归档再清空
+)
+
+// 数据库存储方式
+const (
+	DBModeFile   = "file"   // SQLite 文件，位于 db_path
+	DBModeMemory = "memory" // 内存数据库，只保留最近的记录
+)
+
+// DefaultSourceName 是仅配置 log_path 时使用的来源名称
+const DefaultSourceName = "default"
+
+// Sources 返回所有日志来源；未配置 log_sources 时回退到 log_path
+func (c *Config) Sources() []LogSource {
+	if len(c.LogSources) > 0 {
+		return c.LogSources
+	}
+	return []LogSource{{
+		Name:        DefaultSourceName,
+		Path:        c.LogPath,
+		Format:      c.LogFormat,
+		TimeLayouts: c.LogTimeLayouts,
+		Timezone:    c.LogTimezone,
+		StartFrom:   c.LogStartFrom,
+	}}
+}
+
+// normalizeSources 校验 log_sources，缺省名称使用文件路径，名称与路径均不可重复
+func (c *Config) normalizeSources() error {
+	names := make(map[string]bool, len(c.LogSources))
+	paths := make(map[string]bool, len(c.LogSources))
+	for i := range c.LogSources {
+		src := &c.LogSources[i]
+		if src.Path == "" {
+			return fmt.Errorf("log_sources[%d]: path is required", i)
+		}
+		if src.Name == "" {
+			src.Name = src.Path
+		}
+		if src.Format == "" {
+			src.Format = c.LogFormat
+		}
+		if len(src.TimeLayouts) == 0 {
+			src.TimeLayouts = c.LogTimeLayouts
+		}
+		if src.Timezone == "" {
+			src.Timezone = c.LogTimezone
+		}
+		if src.StartFrom == "" {
+			src.StartFrom = c.LogStartFrom
+		}
+		if names[src.Name] {
+			return fmt.Errorf("log_sources[%d]: duplicate name %q", i, src.Name)
+		}
+		if paths[src.Path] {
+			return fmt.Errorf("log_sources[%d]: duplicate path %q", i, src.Path)
+		}
+		names[src.Name] = true
+		paths[src.Path] = true
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"mosdns-log/config"
+	"mosdns-log/service"
+)
+
+// runImport implements the "import" subcommand:
+//
+//	mosdns-log import [-c config.yaml] [-source name] [-format name] [-timezone tz] mosdns.log.1.gz 'mosdns.log.*'
+//
+// -format, -time-layouts and -timezone default to the configured source named by
+// -source (or the first configured source).
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	configPath := fs.String("c", "config.yaml", "Path to configuration file")
+	source := fs.String("source", "", "Source name for imported rows (default: first configured source)")
+	format := fs.String("format", "", "Log format (default: format of the matching configured source)")
+	timeLayouts := fs.String("time-layouts", "", "Comma-separated timestamp layouts, e.g. millis,rfc3339nano (default: from the matching configured source)")
+	timezone := fs.String("timezone", "", "IANA timezone for timestamps without an offset (default: from the matching configured source)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import [-c config.yaml] [-source name] [-format name] [-time-layouts list] [-timezone tz] <file|glob>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no files to import")
+	}
+
+	conf, err := config.LoadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	appLogFile = setupLogger(conf)
+	defer func() {
+		if appLogFile != nil {
+			appLogFile.Close()
+		}
+	}()
+
+	if !conf.DBPersist {
+		slog.Warn("db_persist is disabled: imported rows will be removed on the next server start")
+	}
+	src := conf.Sources()[0]
+	for _, s := range conf.Sources() {
+		if s.Name == *source {
+			src = s
+			break
+		}
+	}
+	if *source == "" {
+		*source = src.Name
+	}
+	if *format == "" {
+		*format = src.Format
+	}
+	opts := service.ParserOptions{TimeLayouts: src.TimeLayouts, Timezone: src.Timezone}
+	if *timeLayouts != "" {
+		opts.TimeLayouts = strings.Split(*timeLayouts, ",")
+	}
+	if *timezone != "" {
+		opts.Timezone = *timezone
+	}
+
+	if conf.DBMode == config.DBModeMemory {
+		return errors.New("db_mode memory keeps data inside the server process; use POST /api/import instead")
+	}
+	filter, err := service.NewIngestFilter(conf.IngestRules)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatabase(conf)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	importer := service.NewImporter(db, filter)
+
+	// Report progress periodically until the import finishes
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(2 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				p := importer.Progress()
+				slog.Info("Import progress",
+					"file", p.CurrentFile,
+					"files", fmt.Sprintf("%d/%d", p.FilesDone, p.Files),
+					"bytes", fmt.Sprintf("%d/%d", p.Bytes, p.TotalBytes),
+					"inserted", p.Inserted,
+					"duplicates", p.Duplicates)
+			}
+		}
+	}()
+
+	err = importer.Run(ctx, fs.Args(), *source, *format, opts)
+	close(done)
+	return err
+}
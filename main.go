@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -25,7 +26,13 @@ import (
 )
 
 func main() {
-	if err := run(); err != nil {
+	var err error
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		err = runImport(os.Args[2:])
+	} else {
+		err = run()
+	}
+	if err != nil {
 		slog.Error("Application failed", "error", err)
 		os.Exit(1)
 	}
@@ -34,8 +41,6 @@ func main() {
 // appLogFile holds the application log file handle for proper cleanup
 var appLogFile *os.File
 
-const DBFile = "mosdns.db"
-
 func run() error {
 	// CLI Flags
 	configPath := flag.String("c", "config.yaml", "Path to configuration file")
@@ -54,60 +59,57 @@ func run() error {
 	// Setup Logger
 	appLogFile = setupLogger(conf)
 
-	slog.Info("Loaded config", "LogPath", conf.LogPath, "Port", conf.Port, "AppLogPath", conf.AppLogPath, "AppLogLevel", conf.AppLogLevel)
+	slog.Info("Loaded config", "LogPath", conf.LogPath, "LogSources", len(conf.LogSources), "DBMode", conf.DBMode, "DBPath", conf.DBPath, "DBPersist", conf.DBPersist, "Port", conf.Port, "AppLogPath", conf.AppLogPath, "AppLogLevel", conf.AppLogLevel)
 
 	// Database
-	// Recreate DB logic: Check if exists, delete if so.
-	dbFiles := []string{DBFile, DBFile + "-shm", DBFile + "-wal"}
-	for _, f := range dbFiles {
-		if _, err := os.Stat(f); err == nil {
-			slog.Info("Removing existing database file for fresh start...", "file", f)
-			if err := os.Remove(f); err != nil {
-				return fmt.Errorf("failed to remove existing database file %s: %w", f, err)
+	// Recreate DB logic: Check if exists, delete if so (unless persistence is enabled).
+	// The in-memory store never touches the disk.
+	if !conf.DBPersist && conf.DBMode == config.DBModeFile {
+		dbFiles := []string{conf.DBPath, conf.DBPath + "-shm", conf.DBPath + "-wal"}
+		for _, f := range dbFiles {
+			if _, err := os.Stat(f); err == nil {
+				slog.Info("Removing existing database file for fresh start...", "file", f)
+				if err := os.Remove(f); err != nil {
+					return fmt.Errorf("failed to remove existing database file %s: %w", f, err)
+				}
 			}
 		}
 	}
 
-	// Enable WAL mode for better concurrency and set busy timeout
-	// glebarez/sqlite uses _pragma parameter format
-	dsn := fmt.Sprintf("%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)", DBFile)
-	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Error),
-	})
+	db, err := openDatabase(conf)
 	if err != nil {
-		return fmt.Errorf("failed to connect database: %w", err)
-	}
-
-	db.Exec("PRAGMA synchronous = NORMAL;")
-	db.Exec("PRAGMA temp_store = memory;")
-	db.Exec("PRAGMA cache_size = -8000;")
-	db.Exec("PRAGMA mmap_size = 134217728;")
-	db.Exec("PRAGMA wal_autocheckpoint = 1000;")
-	// Migrate
-	if err := db.AutoMigrate(&model.QueryLog{}); err != nil {
-		return fmt.Errorf("failed to migrate database: %w", err)
+		return err
 	}
 
 	// Service: Collector
-	// Use config log path. 
-	logPath := conf.LogPath
-	
-	// Ensure log file exists
-	if _, err := os.Stat(logPath); os.IsNotExist(err) {
-		file, err := os.Create(logPath)
-		if err != nil {
-			return fmt.Errorf("failed to create log file: %w", err)
+	// Ensure every configured log file exists and uses a known format and start position
+	for _, src := range conf.Sources() {
+		if _, err := service.NewParser(src.Format, service.ParserOptions{TimeLayouts: src.TimeLayouts, Timezone: src.Timezone}); err != nil {
+			return fmt.Errorf("log source %s: %w", src.Name, err)
+		}
+		if _, err := service.ParseStartFrom(src.StartFrom, src.Timezone); err != nil {
+			return fmt.Errorf("log source %s: %w", src.Name, err)
+		}
+		if _, err := os.Stat(src.Path); os.IsNotExist(err) {
+			file, err := os.Create(src.Path)
+			if err != nil {
+				return fmt.Errorf("failed to create log file for source %s: %w", src.Name, err)
+			}
+			file.Close()
 		}
-		file.Close()
+	}
+
+	filter, err := service.NewIngestFilter(conf.IngestRules)
+	if err != nil {
+		return err
 	}
 
 	// Initialize Collector
-	collector := service.NewCollector(db, logPath)
+	collector := service.NewCollector(db, conf, filter)
 	collector.Start()
 
 	// Service: Cleaner
-	conf.LogPath = logPath 
-	cleaner := service.NewCleaner(db, conf)
+	cleaner := service.NewCleaner(db, conf, collector)
 	cleaner.Start()
 
 	// Web Server
@@ -121,7 +123,8 @@ func run() error {
 		c.Next()
 	})
 
-	h := api.NewHandler(db)
+	importer := service.NewImporter(db, filter)
+	h := api.NewHandler(db, conf, collector, importer, cleaner)
 	h.RegisterRoutes(r)
 
 	// Port from config
@@ -166,6 +169,9 @@ func run() error {
 	}
 
 	// Stop services
+	slog.Info("Stopping importer...")
+	importer.Stop()
+
 	slog.Info("Stopping collector...")
 	collector.Stop()
 	
@@ -185,12 +191,14 @@ func run() error {
 		}
 	}
 
-	// Remove database file
-	slog.Info("Removing database file...")
-	if err := os.Remove(DBFile); err != nil && !os.IsNotExist(err) {
-		slog.Error("Failed to remove database file", "error", err)
-	} else {
-		slog.Info("Database file removed")
+	// Remove database file (kept when persistence is enabled)
+	if !conf.DBPersist && conf.DBMode == config.DBModeFile {
+		slog.Info("Removing database file...")
+		if err := os.Remove(conf.DBPath); err != nil && !os.IsNotExist(err) {
+			slog.Error("Failed to remove database file", "error", err)
+		} else {
+			slog.Info("Database file removed")
+		}
 	}
 
 	// Close application log file if opened
@@ -202,6 +210,63 @@ func run() error {
 	return nil
 }
 
+// openDatabase opens the SQLite database with tuned pragmas and migrates the schema
+func openDatabase(conf *config.Config) (*gorm.DB, error) {
+	// Enable WAL mode for better concurrency and set busy timeout
+	// glebarez/sqlite uses _pragma parameter format
+	dsn := fmt.Sprintf("%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)", conf.DBPath)
+	if conf.DBMode == config.DBModeMemory {
+		// The memdb VFS lets every pooled connection share one in-memory database
+		// with regular locking, so busy_timeout still applies
+		dsn = "file:/mosdns-log?vfs=memdb&_pragma=busy_timeout(5000)"
+	} else if dir := filepath.Dir(conf.DBPath); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create database directory: %w", err)
+		}
+	}
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Error),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect database: %w", err)
+	}
+	if conf.DBMode == config.DBModeMemory {
+		// memdb frees the database when its last connection closes, so pin one
+		// connection for the lifetime of the process
+		sqlDB, err := db.DB()
+		if err == nil {
+			_, err = sqlDB.Conn(context.Background())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open in-memory database: %w", err)
+		}
+	}
+
+	db.Exec("PRAGMA synchronous = NORMAL;")
+	db.Exec("PRAGMA temp_store = memory;")
+	db.Exec("PRAGMA cache_size = -8000;")
+	db.Exec("PRAGMA mmap_size = 134217728;")
+	db.Exec("PRAGMA wal_autocheckpoint = 1000;")
+	// Migrate
+	if err := db.AutoMigrate(&model.QueryLog{}, &model.QueryAnswer{}, &model.TailCheckpoint{}, &model.SpoolState{}, &model.ParseError{},
+		&model.HourlyRollup{}, &model.DailyRollup{}, &model.RollupState{}); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	if err := service.SetupTimeIndex(db); err != nil {
+		return nil, fmt.Errorf("failed to create time index: %w", err)
+	}
+	if err := service.SetupSearchIndex(db, conf.SearchIndex); err != nil {
+		return nil, fmt.Errorf("failed to set up search index: %w", err)
+	}
+	if conf.DBMode == config.DBModeFile && conf.DBMaxSizeMB > 0 {
+		if err := service.SetupIncrementalVacuum(db); err != nil {
+			return nil, fmt.Errorf("failed to enable incremental vacuum: %w", err)
+		}
+	}
+
+	return db, nil
+}
+
 func setupLogger(c *config.Config) *os.File {
 	var level slog.Level
 	switch strings.ToUpper(c.AppLogLevel) {
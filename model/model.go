@@ -5,11 +5,113 @@ import (
 )
 
 type QueryLog struct {
-	ID       uint      `gorm:"primarykey" json:"id"`
-	ClientIP string    `gorm:"index;size:64" json:"client_ip"`
-	QName    string    `gorm:"index" json:"q_name"`
-	QType    int       `gorm:"index" json:"q_type"`
-	RCode    int       `gorm:"index" json:"r_code"`
-	Elapsed  int64     `gorm:"index" json:"elapsed"`
-	Time     time.Time `gorm:"index" json:"time"`
+	ID         uint      `gorm:"primarykey" json:"id"`
+	Source     string    `gorm:"index;size:64" json:"source"`
+	UQID       int       `gorm:"column:uqid" json:"uqid"`
+	ClientIP   string    `gorm:"index;size:64" json:"client_ip"`
+	Protocol   string    `gorm:"index;size:16" json:"protocol"`
+	ServerName string    `gorm:"index;size:255" json:"server_name"`
+	QName      string    `gorm:"index" json:"q_name"`
+	BaseDomain string    `gorm:"index;size:253" json:"base_domain"` // QName 的可注册域名（eTLD+1），见 service.BaseDomain
+	QType      int       `gorm:"index" json:"q_type"`
+	QClass     int       `json:"q_class"`
+	RCode      int       `gorm:"index" json:"r_code"`
+	Elapsed    int64     `gorm:"index" json:"elapsed"`
+	Time       time.Time `gorm:"index" json:"time"`
+	// TimeEstimated 表示日志中没有可解析的时间戳，Time 为采集时间
+	TimeEstimated bool `gorm:"default:false" json:"time_estimated"`
+
+	Answers []QueryAnswer `gorm:"foreignKey:QueryID" json:"answers,omitempty"`
+}
+
+// QueryAnswer 记录应答中的一条资源记录，来源提供应答内容时写入
+type QueryAnswer struct {
+	ID      uint   `gorm:"primarykey" json:"-"`
+	QueryID uint   `gorm:"index" json:"-"`
+	Type    int    `json:"type"`
+	TTL     uint32 `gorm:"column:ttl" json:"ttl"`
+	Data    string `json:"data"`
+	// IPKey 为 A/AAAA 记录地址的 16 字节（IPv4 映射为 IPv6）十六进制编码，
+	// 字典序与地址顺序一致，用于按 IP 或网段反查
+	IPKey string `gorm:"index;size:32" json:"-"`
 }
+
+// TailCheckpoint 记录采集器在日志文件中的读取位置，用于持久化模式下断点续读
+type TailCheckpoint struct {
+	Path      string    `gorm:"primarykey;size:512" json:"path"`
+	Inode     uint64    `json:"inode"`
+	Offset    int64     `json:"offset"`
+	LineSize  int       `json:"line_size"`
+	LineHash  string    `gorm:"size:16" json:"line_hash"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SpoolState 记录 spool 文件的重放位置。Generation 在每次清空文件时重新生成，
+// 用于识别文件已被清空后残留的旧偏移量
+type SpoolState struct {
+	Path       string    `gorm:"primarykey;size:512" json:"path"`
+	Generation uint64    `json:"generation"`
+	Offset     int64     `json:"offset"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// ParseError 记录一行无法解析的日志，便于发现上游日志格式变化
+type ParseError struct {
+	ID     uint      `gorm:"primarykey" json:"id"`
+	Source string    `gorm:"index;size:64" json:"source"`
+	Path   string    `gorm:"size:512" json:"path"`
+	Offset int64     `json:"offset"`
+	Reason string    `gorm:"index;size:32" json:"reason"`
+	Error  string    `json:"error"`
+	Line   string    `json:"line"`
+	Time   time.Time `json:"time"`
+}
+
+// RollupLatencyBounds 是聚合表中延迟直方图各列的上界（微秒），
+// 与 RollupStats 的 Lat* 列一一对应，LatInf 统计超过最大上界的次数
+var RollupLatencyBounds = []int64{1000, 5000, 10000, 50000, 100000, 500000, 1000000}
+
+// RollupStats 是一个时间段内按维度聚合的查询统计。Bucket 为时间段的起点（UTC），
+// Dim 为 total 时 Key 为空，其余维度（domain、client、qtype、rcode）的 Key 为对应的值。
+type RollupStats struct {
+	Bucket     time.Time `gorm:"primaryKey" json:"bucket"`
+	Source     string    `gorm:"primaryKey;size:64" json:"source"`
+	Dim        string    `gorm:"primaryKey;size:8" json:"dim"`
+	Key        string    `gorm:"primaryKey" json:"key"`
+	Count      int64     `json:"count"`
+	ElapsedSum int64     `json:"elapsed_sum"` // 微秒
+	Lat1ms     int64     `gorm:"column:lat_1ms" json:"-"`
+	Lat5ms     int64     `gorm:"column:lat_5ms" json:"-"`
+	Lat10ms    int64     `gorm:"column:lat_10ms" json:"-"`
+	Lat50ms    int64     `gorm:"column:lat_50ms" json:"-"`
+	Lat100ms   int64     `gorm:"column:lat_100ms" json:"-"`
+	Lat500ms   int64     `gorm:"column:lat_500ms" json:"-"`
+	Lat1s      int64     `gorm:"column:lat_1s" json:"-"`
+	LatInf     int64     `gorm:"column:lat_inf" json:"-"`
+}
+
+// HourlyRollup 按小时聚合，保留 rollup_hourly_days 天
+type HourlyRollup struct {
+	RollupStats
+}
+
+func (HourlyRollup) TableName() string { return "rollup_hourly" }
+
+// DailyRollup 由小时聚合按服务器本地日期汇总，保留 rollup_daily_days 天
+type DailyRollup struct {
+	RollupStats
+}
+
+func (DailyRollup) TableName() string { return "rollup_daily" }
+
+// RollupState 记录聚合进度，只有一行：NextHour 之前的小时、NextDay 之前的日期都已聚合，
+// 其中 ID 不超过 LastID 的原始记录已计入聚合表，之后写入的记录在下一轮聚合时补计
+type RollupState struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	NextHour  time.Time `json:"next_hour"`
+	NextDay   time.Time `json:"next_day"`
+	LastID    uint      `json:"last_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (RollupState) TableName() string { return "rollup_state" }
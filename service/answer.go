@@ -0,0 +1,169 @@
+package service
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	json "github.com/goccy/go-json"
+	"github.com/miekg/dns"
+	"gorm.io/gorm"
+	"mosdns-log/model"
+)
+
+// newAnswer 生成一条应答记录，A/AAAA 记录同时计算用于反查的 IPKey
+func newAnswer(rrtype int, ttl uint32, data string) model.QueryAnswer {
+	a := model.QueryAnswer{Type: rrtype, TTL: ttl, Data: data}
+	if rrtype == int(dns.TypeA) || rrtype == int(dns.TypeAAAA) {
+		if addr, err := netip.ParseAddr(data); err == nil {
+			a.IPKey = ipKey(addr)
+		}
+	}
+	return a
+}
+
+// answersFromRRs 转换应答报文中的资源记录
+func answersFromRRs(rrs []dns.RR) []model.QueryAnswer {
+	if len(rrs) == 0 {
+		return nil
+	}
+	answers := make([]model.QueryAnswer, 0, len(rrs))
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		answers = append(answers, newAnswer(int(hdr.Rrtype), hdr.Ttl, rrData(rr)))
+	}
+	return answers
+}
+
+// rrData 返回资源记录的数据部分（去掉名称、TTL、类别与类型）
+func rrData(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+func ipKey(addr netip.Addr) string {
+	b := addr.As16()
+	return hex.EncodeToString(b[:])
+}
+
+// AnswerIPRange 将 IP 地址或 CIDR 网段转换为 IPKey 的闭区间，用于按地址反查域名
+func AnswerIPRange(s string) (lo, hi string, err error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid IP %q", s)
+		}
+		k := ipKey(addr.Unmap())
+		return k, k, nil
+	}
+
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid CIDR %q", s)
+	}
+	prefix = prefix.Masked()
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+	first := prefix.Addr().As16()
+	last := first
+	for i := bits; i < 128; i++ {
+		last[i/8] |= 1 << (7 - uint(i%8))
+	}
+	return hex.EncodeToString(first[:]), hex.EncodeToString(last[:]), nil
+}
+
+// payloadAnswer 是日志 JSON 中 answers 数组的元素，支持两种写法：
+//
+//	"example.com. 300 IN A 1.2.3.4"
+//	{"type": "A", "ttl": 300, "data": "1.2.3.4"}（type 也可以是数值）
+type payloadAnswer struct {
+	Type int
+	TTL  uint32
+	Data string
+}
+
+func (a *payloadAnswer) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return err
+		}
+		if rr == nil {
+			return errors.New("empty answer")
+		}
+		a.Type = int(rr.Header().Rrtype)
+		a.TTL = rr.Header().Ttl
+		a.Data = rrData(rr)
+		return nil
+	}
+
+	var obj struct {
+		Type json.RawMessage `json:"type"`
+		TTL  uint32          `json:"ttl"`
+		Data string          `json:"data"`
+	}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return err
+	}
+	raw := string(obj.Type)
+	if s, err := strconv.Unquote(raw); err == nil {
+		a.Type = qtypeFromName(s)
+	} else {
+		a.Type, _ = strconv.Atoi(raw)
+	}
+	a.TTL = obj.TTL
+	a.Data = obj.Data
+	return nil
+}
+
+func toAnswers(src []payloadAnswer) []model.QueryAnswer {
+	if len(src) == 0 {
+		return nil
+	}
+	answers := make([]model.QueryAnswer, 0, len(src))
+	for _, a := range src {
+		answers = append(answers, newAnswer(a.Type, a.TTL, a.Data))
+	}
+	return answers
+}
+
+// insertAnswers 写入已分配 ID 的查询记录的应答
+func insertAnswers(db *gorm.DB, logs []*model.QueryLog) error {
+	const sqlHeader = "INSERT INTO query_answers (" + answerInsertColumns + ") VALUES "
+	var (
+		valArgs      []interface{}
+		placeholders []string
+	)
+	flush := func() error {
+		if len(placeholders) == 0 {
+			return nil
+		}
+		err := db.Exec(sqlHeader+strings.Join(placeholders, ","), valArgs...).Error
+		valArgs, placeholders = valArgs[:0], placeholders[:0]
+		return err
+	}
+
+	for _, l := range logs {
+		for _, a := range l.Answers {
+			placeholders = append(placeholders, "(?, ?, ?, ?, ?)")
+			valArgs = appendAnswerArgs(valArgs, l.ID, a)
+			if len(placeholders) >= maxInsertRows {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return flush()
+}
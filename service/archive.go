@@ -0,0 +1,124 @@
+package service
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// archiveName 返回第 n 个归档文件名，例如 mosdns.log.1.gz
+func archiveName(path string, n int) string {
+	return fmt.Sprintf("%s.%d.gz", path, n)
+}
+
+// archiveLog 将日志文件压缩为 path.1.gz，已有归档依次后移，超出 keep 的最旧归档被删除，返回归档的字节数。
+// 只负责复制，截断由 Collector 在确认数据入库后完成。
+func archiveLog(path string, keep int) (int64, error) {
+	if keep < 1 {
+		keep = 1
+	}
+
+	for i := keep - 1; i >= 1; i-- {
+		if err := os.Rename(archiveName(path, i), archiveName(path, i+1)); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	// 先写临时文件再改名，避免中途失败留下损坏的归档
+	tmp := archiveName(path, 1) + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	zw := gzip.NewWriter(dst)
+	n, err := io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, archiveName(path, 1)); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	slog.Info("Log file archived", "path", path, "archive", archiveName(path, 1), "bytes", n)
+	return n, nil
+}
+
+// appendArchive 把 data 作为新的 gzip 成员追加到 path.1.gz，解压时与原有内容首尾相接
+func appendArchive(path string, data []byte) error {
+	f, err := os.OpenFile(archiveName(path, 1), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	_, err = zw.Write(data)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		slog.Info("Appended to log archive", "archive", archiveName(path, 1), "bytes", len(data))
+	}
+	return err
+}
+
+// pruneArchives 删除编号超出 keep 或早于 maxAge 的归档；maxAge <= 0 表示不按时间清理
+func pruneArchives(path string, keep int, maxAge time.Duration) {
+	matches, err := filepath.Glob(path + ".*.gz")
+	if err != nil {
+		return
+	}
+
+	deadline := time.Now().Add(-maxAge)
+	for _, m := range matches {
+		idx := strings.TrimSuffix(strings.TrimPrefix(m, path+"."), ".gz")
+		n, err := strconv.Atoi(idx)
+		if err != nil {
+			continue
+		}
+
+		expired := n > keep
+		if !expired && maxAge > 0 {
+			if fi, err := os.Stat(m); err == nil && fi.ModTime().Before(deadline) {
+				expired = true
+			}
+		}
+		if !expired {
+			continue
+		}
+
+		if err := os.Remove(m); err != nil {
+			slog.Error("Failed to remove log archive", "archive", m, "error", err)
+		} else {
+			slog.Info("Log archive removed", "archive", m)
+		}
+	}
+}
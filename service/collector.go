@@ -3,141 +3,467 @@ package service
 import (
 	"bufio"
 	"context"
+	"fmt"
+	"hash/fnv"
 	"io"
 	"log/slog"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
-	"unsafe"
 
-	json "github.com/goccy/go-json"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 	"mosdns-log/config"
 	"mosdns-log/model"
 )
 
 const (
-	BatchSize       = 100
-	HeaderScanLimit = 200
-	timeLayout      = "2006-01-02T15:04:05.000-0700"
+	// rowQueue syslog、dnstap 等接收端到 rowWorker 的队列长度
+	rowQueue = 1024
+	// maxParseWorkers parse_workers 未配置时每个来源最多使用的解析协程数
+	maxParseWorkers = 4
 )
 
-// LogPayload 用于解析 JSON 日志行
-type LogPayload struct {
-	UQID       int    `json:"uqid"`
-	Client     string `json:"client"`
-	Protocol   string `json:"protocol"`
-	ServerName string `json:"server_name"`
-	QName      string `json:"qname"`
-	QType      int    `json:"qtype"`
-	QClass     int    `json:"qclass"`
-	RespRCode  int    `json:"resp_rcode"`
-	Elapsed    string `json:"elapsed"`
-}
-
-func (p *LogPayload) Reset() {
-	p.UQID = 0; p.Client = ""; p.Protocol = ""; p.ServerName = ""
-	p.QName = ""; p.QType = 0; p.QClass = 0; p.RespRCode = 0; p.Elapsed = ""
-}
-
-func stringToBytes(s string) []byte {
-	return unsafe.Slice(unsafe.StringData(s), len(s))
-}
-
 // ============================================================================
 // Collector: 日志采集器
 // ============================================================================
 
 type Collector struct {
 	db          *gorm.DB
-	logPath     string
+	sources     []config.LogSource
+	persist     bool
 	ctx         context.Context
 	cancel      context.CancelFunc
 	wg          sync.WaitGroup
-	batchChan   chan []*model.QueryLog
-	payloadPool sync.Pool
+	producers   sync.WaitGroup // 向 batchChan 写入数据的 goroutine
+	batchChan   chan *ingestBatch
+	batchMu     sync.RWMutex // Ingest 发送时持有读锁，关闭 batchChan 时持有写锁
+	batchClosed bool
+	rotateChans map[string]chan *rotateRequest
+	tailDone    map[string]chan struct{} // tailWorker 退出时关闭，按日志路径
+	syslog      *syslogReceiver
+	dnstap      *dnstapReceiver
+	rawParser   Parser // 推送接口中原始日志行使用的解析器
+	filter      *IngestFilter
 	fileMu      sync.Mutex
+
+	batchSize     int
+	flushInterval time.Duration
+	parseWorkers  int          // 每个来源的解析协程数
+	inserter      *logInserter // 为 nil 时回退到拼接 SQL 写入
+
+	spool *spool      // 为 nil 时写入失败的批次直接丢弃
+	ring  *memoryRing // 非 nil 时为内存数据库模式，写入后淘汰最旧的记录
+
+	parseStats     parseStats
+	metrics        collectorMetrics
+	quarantine     chan *model.ParseError // 为 nil 时不写入 parse_errors 表
+	quarantineKeep int
 }
 
-func NewCollector(db *gorm.DB, logPath string) *Collector {
+// ingestBatch 是发送给 dbWorker 的一批数据，checkpoint 与日志在同一事务中写入
+type ingestBatch struct {
+	logs       []*model.QueryLog
+	checkpoint *model.TailCheckpoint
+	done       chan error // 非空时在写入完成后回传结果
+}
+
+// rotateRequest 请求 tailWorker 在读完并入库当前文件后执行归档与截断
+type rotateRequest struct {
+	archive *rotateArchive // 为 nil 时直接截断
+	result  chan error
+}
+
+// rotateArchive 是轮转时的归档操作。create 归档当前文件并返回归档的字节数；
+// append 把归档之后、截断之前追加的内容补写到同一归档中
+type rotateArchive struct {
+	create func() (int64, error)
+	append func(data []byte) error
+}
+
+// rotateHandoffTimeout 等待 tailWorker 接收轮转请求的最长时间
+const rotateHandoffTimeout = time.Minute
+
+func NewCollector(db *gorm.DB, conf *config.Config, filter *IngestFilter) *Collector {
 	// 调整 GORM Logger 以避免插入大量日志时的噪音
 	if db.Config.Logger == nil || db.Config.Logger != logger.Discard {
 		db.Config.Logger = logger.Default.LogMode(logger.Silent)
 	}
 
+	sources := conf.Sources()
+	rotateChans := make(map[string]chan *rotateRequest, len(sources))
+	tailDone := make(map[string]chan struct{}, len(sources))
+	tails := make(map[string]*tailMetrics, len(sources))
+	for _, src := range sources {
+		rotateChans[src.Path] = make(chan *rotateRequest)
+		tailDone[src.Path] = make(chan struct{})
+		tails[src.Name] = &tailMetrics{path: src.Path}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Collector{
-		db:        db,
-		logPath:   logPath,
-		ctx:       ctx,
-		cancel:    cancel,
-		batchChan: make(chan []*model.QueryLog, 200),
-		payloadPool: sync.Pool{
-			New: func() interface{} { return &LogPayload{} },
+	c := &Collector{
+		db:          db,
+		sources:     sources,
+		persist:     conf.DBPersist,
+		ctx:         ctx,
+		cancel:      cancel,
+		batchChan:   make(chan *ingestBatch, 200),
+		rotateChans: rotateChans,
+		tailDone:    tailDone,
+		rawParser:   newMosdnsXParser(defaultTimeParser),
+		filter:      filter,
+		parseStats: parseStats{
+			parsed:   make(map[string]int64),
+			failures: make(map[string]map[string]int64),
 		},
+		metrics:       collectorMetrics{tails: tails},
+		batchSize:     conf.BatchSize,
+		flushInterval: time.Duration(conf.FlushIntervalMs) * time.Millisecond,
+		parseWorkers:  conf.ParseWorkers,
+	}
+	if c.parseWorkers == 0 {
+		c.parseWorkers = min(runtime.GOMAXPROCS(0), maxParseWorkers)
+	}
+	if ins, err := newLogInserter(db); err != nil {
+		slog.Warn("Failed to prepare insert statements, using plain inserts", "error", err)
+	} else {
+		c.inserter = ins
+	}
+	if conf.DBMode == config.DBModeMemory {
+		c.ring = &memoryRing{
+			maxRows:  int64(conf.MemoryMaxRows),
+			maxBytes: int64(conf.MemoryMaxSizeMB) * 1024 * 1024,
+		}
+	}
+	if conf.SpoolPath != "" {
+		c.initSpool(conf.SpoolPath, int64(conf.SpoolMaxSizeMB)*1024*1024)
 	}
+	if conf.ParseErrorsKeep > 0 {
+		c.quarantine = make(chan *model.ParseError, quarantineQueue)
+		c.quarantineKeep = conf.ParseErrorsKeep
+	}
+	if conf.Syslog.Listen != "" {
+		r, err := newSyslogReceiver(conf.Syslog)
+		if err != nil {
+			slog.Error("Syslog receiver disabled", "error", err)
+		} else {
+			c.syslog = r
+		}
+	}
+	if conf.Dnstap.Listen != "" {
+		c.dnstap = newDnstapReceiver(conf.Dnstap)
+	}
+	return c
 }
 
 func (c *Collector) Start() {
-	c.wg.Add(2)
+	c.wg.Add(1)
 	go c.dbWorker()
-	go c.tailWorker()
-	slog.Info("Collector started")
+	if c.quarantine != nil {
+		c.wg.Add(1)
+		go c.quarantineWorker()
+	}
+	if c.spool != nil {
+		c.wg.Add(1)
+		go c.spoolWorker()
+	}
+
+	// 每个来源一个 tailWorker，所有生产者退出后关闭 batchChan
+	c.producers.Add(len(c.sources))
+	for _, src := range c.sources {
+		go c.tailWorker(src)
+	}
+	if c.syslog != nil {
+		c.startSyslog()
+	}
+	if c.dnstap != nil {
+		c.startDnstap()
+	}
+	go func() {
+		c.producers.Wait()
+		c.batchMu.Lock()
+		c.batchClosed = true
+		close(c.batchChan)
+		c.batchMu.Unlock()
+	}()
+	slog.Info("Collector started", "sources", len(c.sources), "persist", c.persist)
 }
 
+// Stop 停止所有生产者，并等待 dbWorker 写完（或写入 spool）所有已读取的数据
 func (c *Collector) Stop() {
 	c.cancel()
 	c.wg.Wait()
+	if c.spool != nil {
+		if c.spool.pending() {
+			slog.Warn("Spool still has unreplayed batches", "path", c.spool.path)
+		}
+		c.spool.close()
+		if !c.persist {
+			os.Remove(c.spool.path)
+		}
+	}
+	if c.inserter != nil {
+		c.inserter.close()
+	}
 	slog.Info("Collector stopped")
 }
 
+// RotateSource 协调日志轮转：对应的 tailWorker 先把文件读到末尾并确认全部入库，
+// 然后按 archive（可为 nil）归档，再读完归档期间追加的内容，立即将文件截断为 0 并从头继续读取。
+// 未被采集的日志文件，或其 tailWorker 已退出、长时间未响应时返回错误，调用方可自行处理。
+func (c *Collector) RotateSource(path string, archive *rotateArchive) error {
+	ch, ok := c.rotateChans[path]
+	if !ok {
+		return fmt.Errorf("log file %s is not collected", path)
+	}
+	req := &rotateRequest{archive: archive, result: make(chan error, 1)}
+	timer := time.NewTimer(rotateHandoffTimeout)
+	defer timer.Stop()
+	select {
+	case ch <- req:
+	case <-c.tailDone[path]:
+		return fmt.Errorf("log file %s is no longer being tailed", path)
+	case <-timer.C:
+		return fmt.Errorf("tail worker for %s did not accept rotation within %s", path, rotateHandoffTimeout)
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+	// tailWorker 在接收请求后总会回传结果
+	select {
+	case err := <-req.result:
+		return err
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+}
+
 // dbWorker 负责批量插入数据库
 func (c *Collector) dbWorker() {
 	defer c.wg.Done()
-	const sqlHeader = "INSERT INTO query_logs (client_ip, q_name, q_type, r_code, elapsed, time) VALUES "
-	for batch := range c.batchChan {
-		c.execRawInsert(sqlHeader, batch)
+	for b := range c.batchChan {
+		err := c.storeBatch(b)
+		if err == nil && c.ring != nil {
+			c.trimMemory()
+		}
+		if b.done != nil {
+			b.done <- err
+		}
+	}
+}
+
+// writeBatch 在一个事务中写入一批日志及其应答，并更新读取断点与 spool 重放位置（nil 会被忽略），
+// 保证持久化模式下重启后不丢不重
+func (c *Collector) writeBatch(logs []*model.QueryLog, checkpoint *model.TailCheckpoint, state *model.SpoolState) error {
+	dbCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	err := c.db.WithContext(dbCtx).Transaction(func(tx *gorm.DB) error {
+		insert := execRawInsert
+		if c.inserter != nil {
+			insert = c.inserter.insert
+		}
+		if err := insert(tx, logs); err != nil {
+			return err
+		}
+		if checkpoint != nil {
+			if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(checkpoint).Error; err != nil {
+				return err
+			}
+		}
+		if state != nil {
+			if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(state).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	c.metrics.inserted(logs, time.Since(start), err)
+	if err != nil {
+		slog.Error("[DB] Insert failed", "error", err, "rows", len(logs))
+	}
+	return err
+}
+
+// rowWorker 将 syslog、dnstap 等接收端解析出的记录攒批后送入 batchChan
+func (c *Collector) rowWorker(rows <-chan *model.QueryLog) {
+	defer c.producers.Done()
+
+	buffer := make([]*model.QueryLog, 0, c.batchSize)
+	ticker := time.NewTicker(c.flushInterval)
+	defer ticker.Stop()
+
+	sendBuffer := func() {
+		if len(buffer) == 0 {
+			return
+		}
+		// dbWorker 在所有生产者退出后才结束，退出时阻塞发送也不会丢失数据
+		c.batchChan <- &ingestBatch{logs: buffer}
+		c.metrics.queued(len(buffer))
+		buffer = make([]*model.QueryLog, 0, c.batchSize)
+	}
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			sendBuffer()
+			return
+		case <-ticker.C:
+			sendBuffer()
+		case ql := <-rows:
+			buffer = append(buffer, ql)
+			if len(buffer) >= c.batchSize {
+				sendBuffer()
+			}
+		}
 	}
 }
 
-// execRawInsert 执行原生 SQL 插入以提高性能
-func (c *Collector) execRawInsert(sqlHeader string, logs []*model.QueryLog) {
+// maxInsertRows 单条 INSERT 语句的最大行数，避免超出 SQLite 参数数量上限
+const maxInsertRows = 1000
+
+// execRawInsert 执行原生 SQL 插入以提高性能。
+// 记录带有应答时通过 last_insert_rowid() 回填 ID 并写入 query_answers，
+// 因此必须在事务中调用，保证两条语句使用同一连接且期间没有其他写入。
+func execRawInsert(db *gorm.DB, logs []*model.QueryLog) error {
+	for len(logs) > maxInsertRows {
+		if err := execRawInsert(db, logs[:maxInsertRows]); err != nil {
+			return err
+		}
+		logs = logs[maxInsertRows:]
+	}
 	if len(logs) == 0 {
-		return
+		return nil
 	}
-	valArgs := make([]interface{}, 0, len(logs)*6)
+	const sqlHeader = "INSERT INTO query_logs (" + logInsertColumns + ") VALUES "
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", logInsertCols), ", ") + ")"
+	valArgs := make([]interface{}, 0, len(logs)*logInsertCols)
 	placeholders := make([]string, 0, len(logs))
 	for _, l := range logs {
-		placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?)")
-		valArgs = append(valArgs, l.ClientIP, l.QName, l.QType, l.RCode, l.Elapsed, l.Time)
+		placeholders = append(placeholders, row)
+		valArgs = appendLogArgs(valArgs, l)
 	}
 	var sb strings.Builder
 	sb.WriteString(sqlHeader)
 	sb.WriteString(strings.Join(placeholders, ","))
 
-	dbCtx, cancel := context.WithTimeout(c.ctx, 5*time.Second)
-	defer cancel()
+	if err := db.Exec(sb.String(), valArgs...).Error; err != nil {
+		return err
+	}
+	if !hasAnswers(logs) {
+		return nil
+	}
+
+	// 单条多行 INSERT 分配的 rowid 是连续的
+	var lastID int64
+	if err := db.Raw("SELECT last_insert_rowid()").Scan(&lastID).Error; err != nil {
+		return err
+	}
+	firstID := lastID - int64(len(logs)) + 1
+	for i, l := range logs {
+		l.ID = uint(firstID + int64(i))
+	}
+	return insertAnswers(db, logs)
+}
 
-	err := c.db.WithContext(dbCtx).Exec(sb.String(), valArgs...).Error
+func hasAnswers(logs []*model.QueryLog) bool {
+	for _, l := range logs {
+		if len(l.Answers) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// loadCheckpoint 读取上次保存的断点，非持久化模式或不存在时返回 nil
+func (c *Collector) loadCheckpoint(path string) *model.TailCheckpoint {
+	if !c.persist {
+		return nil
+	}
+	// spool 中尚未重放的断点总是比数据库中的新
+	if c.spool != nil {
+		if cp := c.spool.checkpoint(path); cp != nil {
+			return cp
+		}
+	}
+	var cp model.TailCheckpoint
+	err := c.db.Where("path = ?", path).Limit(1).Find(&cp).Error
 	if err != nil {
-		slog.Error("[DB] Insert failed", "error", err)
+		slog.Error("Failed to load tail checkpoint", "path", path, "error", err)
+		return nil
 	}
+	if cp.Path == "" {
+		return nil
+	}
+	return &cp
 }
 
-// tailWorker 负责监听文件变化并解析日志
-func (c *Collector) tailWorker() {
-	defer c.wg.Done()
-	defer close(c.batchChan)
+// verifyCheckpoint 校验断点是否仍指向同一文件的同一位置：
+// inode 一致、文件未被截断，且断点前最后一行的哈希未变
+func verifyCheckpoint(file *os.File, inode uint64, size int64, cp *model.TailCheckpoint) bool {
+	if cp.Inode != inode || cp.Offset > size || cp.Offset < int64(cp.LineSize) {
+		return false
+	}
+	if cp.LineSize == 0 {
+		return cp.Offset == 0
+	}
+	buf := make([]byte, cp.LineSize)
+	if _, err := file.ReadAt(buf, cp.Offset-int64(cp.LineSize)); err != nil {
+		return false
+	}
+	return hashLine(buf) == cp.LineHash
+}
+
+func hashLine(b []byte) string {
+	h := fnv.New64a()
+	h.Write(b)
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+func fileInode(fi os.FileInfo) uint64 {
+	if sys := fi.Sys(); sys != nil {
+		if statT, ok := sys.(*syscall.Stat_t); ok {
+			return statT.Ino
+		}
+	}
+	return 0
+}
+
+// tailWorker 负责监听文件变化并读取日志，读到的行按块交给解析流水线
+func (c *Collector) tailWorker(src config.LogSource) {
+	defer c.producers.Done()
+	defer close(c.tailDone[src.Path])
+
+	opts := ParserOptions{TimeLayouts: src.TimeLayouts, Timezone: src.Timezone}
+	parser, err := NewParser(src.Format, opts)
+	if err != nil {
+		slog.Error("Failed to create log parser", "source", src.Name, "error", err)
+		return
+	}
+	startPos, err := ParseStartFrom(src.StartFrom, src.Timezone)
+	if err != nil {
+		slog.Error("Invalid start position", "source", src.Name, "error", err)
+		return
+	}
+	tm := c.metrics.tails[src.Name]
 
 	var (
-		file   *os.File
-		reader *bufio.Reader
-		inode  uint64
-		offset int64
-		err    error
+		file      *os.File
+		reader    *bufio.Reader
+		inode     uint64
+		offset    int64
+		partial   string
+		carry     string           // 截断时未写完的半行，与截断后文件开头的剩余部分拼接
+		capture   *strings.Builder // 非 nil 时记录 readToEOF 读到的原始内容
+		lastLine  string
+		chunk     []string
+		reopened  bool
+		unflushed bool // 有已读取但尚未要求 batchWorker 发送的行
 	)
 
 	defer func() {
@@ -148,72 +474,282 @@ func (c *Collector) tailWorker() {
 		c.fileMu.Unlock()
 	}()
 
-	openFile := func(seekEnd bool) bool {
+	pl := c.startPipeline(src, parser, tm)
+	chunkSize := min(chunkLines, c.batchSize)
+	chunkStart := int64(0)
+
+	// submit 将当前块连同读取位置交给流水线；flush 要求 batchWorker 处理完后立即发送，
+	// sync 非空时等待写入结果
+	submit := func(flush bool, sync chan error) {
+		if len(chunk) == 0 && !reopened && sync == nil && !(flush && unflushed) {
+			return
+		}
+		if len(chunk) > 0 {
+			tm.lastReadAt.Store(time.Now().UnixNano())
+		}
+		pl.submit(&lineChunk{
+			lines:    chunk,
+			start:    chunkStart,
+			inode:    inode,
+			end:      offset,
+			lastLine: lastLine,
+			reopened: reopened,
+			flush:    flush,
+			sync:     sync,
+		})
+		chunk = make([]string, 0, chunkSize)
+		chunkStart = offset
+		reopened = false
+		if flush || sync != nil {
+			unflushed = false
+		}
+	}
+	// 退出时提交剩余的行，并等待 batchWorker 将其送入 batchChan
+	defer func() {
+		submit(true, nil)
+		pl.close()
+	}()
+
+	// openFile 打开日志文件并定位到 pos；pos 为 checkpoint 或时间戳模式时参考断点 cp
+	openFile := func(pos StartPosition, cp *model.TailCheckpoint) bool {
+		// 旧文件中已读取的行使用旧的读取位置
+		submit(false, nil)
+
 		c.fileMu.Lock()
 		defer c.fileMu.Unlock()
 
-		file, err = os.Open(c.logPath)
+		file, err = os.Open(src.Path)
 		if err != nil {
-			slog.Error("Failed to open log file", "path", c.logPath, "error", err)
+			slog.Error("Failed to open log file", "source", src.Name, "path", src.Path, "error", err)
 			return false
 		}
 
+		var size int64
 		stat, err := file.Stat()
 		if err == nil {
-			if sys := stat.Sys(); sys != nil {
-				if statT, ok := sys.(*syscall.Stat_t); ok {
-					inode = statT.Ino
-				}
-			}
+			inode = fileInode(stat)
+			size = stat.Size()
 		}
 
-		if seekEnd {
-			file.Seek(0, io.SeekEnd)
-		} else {
-			file.Seek(0, io.SeekStart)
+		cpValid := cp != nil && verifyCheckpoint(file, inode, size, cp)
+		if cp != nil && !cpValid {
+			slog.Info("Checkpoint does not match current log file", "source", src.Name, "path", src.Path)
 		}
 
-		offset, _ = file.Seek(0, io.SeekCurrent)
+		var start int64
+		switch pos.Mode {
+		case config.StartEnd:
+			start = lastLineStart(file, size)
+		case startTime:
+			begin := time.Now()
+			// 探测使用独立的解析器，避免影响有状态解析器（如 dnsmasq）的配对
+			if probe, err := NewParser(src.Format, opts); err == nil {
+				start = seekTime(file, size, probe, pos.Time)
+			}
+			slog.Info("Located start time in log file", "source", src.Name, "time", pos.Time, "offset", start, "took", time.Since(begin))
+			// 断点在该位置之后时从断点继续，避免重启后重复读取
+			if cpValid && cp.Offset > start {
+				start = cp.Offset
+				slog.Info("Resuming from checkpoint", "source", src.Name, "path", src.Path, "offset", cp.Offset)
+			}
+		case config.StartCheckpoint:
+			if cpValid {
+				start = cp.Offset
+				slog.Info("Resuming from checkpoint", "source", src.Name, "path", src.Path, "offset", cp.Offset)
+			}
+		}
+
+		offset, _ = file.Seek(start, io.SeekStart)
+		chunkStart = offset
+		partial, carry, lastLine = "", "", lineBefore(file, offset)
 		reader = bufio.NewReader(file)
-		slog.Info("Log file opened", "path", c.logPath, "offset", offset)
+		// 打开后立即记录一次断点，确保轮转后旧断点失效
+		reopened = true
+		slog.Info("Log file opened", "source", src.Name, "path", src.Path, "offset", offset)
 		return true
 	}
 
-	// 首次启动时尝试打开文件
-	if !openFile(false) {
+	// 首次启动时按 start_from 定位，持久化模式下可从断点恢复
+	var cp *model.TailCheckpoint
+	if startPos.Mode == config.StartCheckpoint || startPos.Mode == startTime {
+		cp = c.loadCheckpoint(src.Path)
+	}
+	if !openFile(startPos, cp) {
 		return
 	}
 
-	buffer := make([]*model.QueryLog, 0, BatchSize)
-	ticker := time.NewTicker(3 * time.Second)
-	defer ticker.Stop()
+	// handleLine 处理一行完整日志（会拼接之前保留的半行）
+	handleLine := func(line string) {
+		if partial != "" {
+			line = partial + line
+			partial = ""
+		}
+		// offset 与 lastLine 只计入当前文件中的内容，拼接的 carry 来自截断前的文件
+		offset += int64(len(line))
+		lastLine = line
+		if carry != "" {
+			line = carry + line
+			carry = ""
+		}
+		c.metrics.linesRead.Add(1)
+		chunk = append(chunk, line)
+		unflushed = true
+		if len(chunk) >= chunkSize {
+			submit(false, nil)
+		}
+	}
 
-	sendBuffer := func() {
-		if len(buffer) == 0 {
-			return
+	// readToEOF 读取当前句柄中所有完整的行，末尾不完整的部分保留在 partial 中
+	readToEOF := func() error {
+		for {
+			line, err := reader.ReadString('\n')
+			if capture != nil {
+				capture.WriteString(line)
+			}
+			if err == nil {
+				handleLine(line)
+				continue
+			}
+			partial += line
+			if err == io.EOF {
+				return nil
+			}
+			return err
 		}
+	}
+
+	// drainFile 在外部改名轮转后把旧 inode 读到末尾，返回补读的字节数。
+	// 旧文件此后不会再被追加，末尾残留的半行也按完整行处理。
+	drainFile := func() int64 {
+		start := offset
+		for {
+			if err := readToEOF(); err != nil {
+				slog.Error("Error draining rotated log file", "source", src.Name, "error", err)
+				break
+			}
+			// 读取期间旧文件可能仍在被写入，若还有新内容则继续读
+			fi, statErr := file.Stat()
+			if statErr != nil || fi.Size() <= offset+int64(len(partial)) {
+				break
+			}
+		}
+		if partial != "" {
+			handleLine("")
+		}
+		return offset - start
+	}
+
+	// flushSync 提交已读取的行并等待 dbWorker 确认写入
+	flushSync := func() error {
+		done := make(chan error, 1)
+		submit(false, done)
 		select {
-		case c.batchChan <- buffer:
-			buffer = make([]*model.QueryLog, 0, BatchSize)
+		case err := <-done:
+			return err
 		case <-c.ctx.Done():
-			// 退出时的最后尝试
-			timer := time.NewTimer(100 * time.Millisecond)
-			select {
-			case c.batchChan <- buffer:
-			case <-timer.C:
+			return c.ctx.Err()
+		}
+	}
+
+	// readUntilStable 反复读到末尾，直到文件不再增长
+	readUntilStable := func() error {
+		for {
+			if err := readToEOF(); err != nil {
+				return err
+			}
+			fi, err := file.Stat()
+			if err != nil || fi.Size() <= offset+int64(len(partial)) {
+				return nil
 			}
-			timer.Stop()
-			buffer = nil
+		}
+	}
+
+	// rotate 处理 Cleaner 发起的轮转：读完并确认入库 -> 归档 -> 补读 -> 立即截断 -> 补写归档。
+	// 补读与截断之间不经过数据库写入等耗时操作，尽量缩小期间追加的内容被截断丢失的窗口
+	rotate := func(req *rotateRequest) error {
+		if err := readToEOF(); err != nil {
+			return err
+		}
+		if err := flushSync(); err != nil {
+			return fmt.Errorf("flush before truncate: %w", err)
+		}
+
+		consumed := offset + int64(len(partial)) // 已从文件读取的字节数
+		archived := int64(0)
+		if req.archive != nil {
+			n, err := req.archive.create()
+			if err != nil {
+				return fmt.Errorf("archive log file: %w", err)
+			}
+			archived = n
+			capture = &strings.Builder{}
+		}
+		err := readUntilStable()
+		var tail string
+		if capture != nil {
+			tail = capture.String()
+			capture = nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Truncate(src.Path, 0); err != nil {
+			return err
+		}
+
+		// 归档只包含 create 时的文件内容，补读到的部分追加到同一归档中
+		if skip := archived - consumed; req.archive != nil && skip < int64(len(tail)) {
+			if err := req.archive.append([]byte(tail[max(skip, 0):])); err != nil {
+				slog.Error("Failed to append to log archive", "source", src.Name, "error", err)
+			}
+		}
+
+		// 截断后从头读取，截断时未写完的半行保留下来与新文件开头的剩余部分拼接
+		c.fileMu.Lock()
+		file.Seek(0, io.SeekStart)
+		c.fileMu.Unlock()
+		reader.Reset(file)
+		carry, partial = partial, ""
+		offset, lastLine = 0, ""
+		chunkStart = 0
+		reopened = true
+		return nil
+	}
+	rotateChan := c.rotateChans[src.Path]
+	notify := c.watchFile(src.Path)
+
+	// waitForData 在 EOF 后等待文件变化：优先使用 inotify 事件，不可用时按固定间隔轮询
+	waitForData := func() {
+		// EOF 时先把已读取的行交给解析协程
+		submit(false, nil)
+		if notify == nil {
+			time.Sleep(pollInterval)
+			submit(true, nil) // EOF 时立即发送缓存
+			return
+		}
+
+		timeout := watchIdleTimeout
+		if unflushed {
+			timeout = watchFlushDelay
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-notify:
+		case <-timer.C:
+			submit(true, nil)
+		case req := <-rotateChan:
+			req.result <- rotate(req)
+		case <-c.ctx.Done():
 		}
 	}
 
 	for {
 		select {
 		case <-c.ctx.Done():
-			sendBuffer()
 			return
-		case <-ticker.C:
-			sendBuffer()
+		case req := <-rotateChan:
+			req.result <- rotate(req)
 		default:
 		}
 
@@ -221,31 +757,35 @@ func (c *Collector) tailWorker() {
 
 		if err != nil {
 			if err == io.EOF {
-				time.Sleep(500 * time.Millisecond)
-				sendBuffer() // EOF 时立即发送缓存
+				// 保留未写完的半行，等待后续内容补齐
+				partial += line
+
+				waitForData()
 
-				newStat, statErr := os.Stat(c.logPath)
+				newStat, statErr := os.Stat(src.Path)
 				if statErr != nil {
 					continue
 				}
 
-				var newInode uint64
-				if sys := newStat.Sys(); sys != nil {
-					if statT, ok := sys.(*syscall.Stat_t); ok {
-						newInode = statT.Ino
-					}
-				}
-
 				// 检测轮转：Inode 改变（外部轮转）或 大小变小（Truncate）
-				if newInode != inode || newStat.Size() < offset {
-					slog.Info("Log rotation detected, reopening file...")
+				renamed := fileInode(newStat) != inode
+				if renamed || newStat.Size() < offset {
+					if renamed {
+						// 改名轮转：旧文件仍可通过当前句柄读取，先读完再切换
+						drained := drainFile()
+						submit(true, nil)
+						slog.Info("Log rotation detected, drained previous file",
+							"source", src.Name, "drained_bytes", drained, "offset", offset)
+					} else {
+						slog.Info("Log truncation detected, reopening file...", "source", src.Name)
+					}
 
 					c.fileMu.Lock()
 					file.Close()
 					file = nil
 					c.fileMu.Unlock()
 
-					if openFile(false) {
+					if openFile(StartPosition{Mode: config.StartBeginning}, nil) {
 						continue
 					} else {
 						return
@@ -259,96 +799,46 @@ func (c *Collector) tailWorker() {
 			}
 		}
 
-		offset += int64(len(line))
-		if ql := c.parseLine(line); ql != nil {
-			buffer = append(buffer, ql)
-			if len(buffer) >= BatchSize {
-				sendBuffer()
-			}
-		}
+		handleLine(line)
 	}
 }
 
-func (c *Collector) parseLine(text string) *model.QueryLog {
-	if len(text) < 50 {
-		return nil
-	}
-
-	scanLen := len(text)
-	if scanLen > HeaderScanLimit {
-		scanLen = HeaderScanLimit
-	}
-	if !strings.Contains(text[:scanLen], "_query_summary") {
-		return nil
-	}
-
-	idx := strings.Index(text, "{")
-	if idx == -1 {
-		return nil
-	}
-
-	p := c.payloadPool.Get().(*LogPayload)
-	defer func() {
-		p.Reset()
-		c.payloadPool.Put(p)
-	}()
-
-	if err := json.Unmarshal(stringToBytes(text[idx:]), p); err != nil {
-		return nil
-	}
-
-	dur, _ := time.ParseDuration(p.Elapsed)
-
-	return &model.QueryLog{
-		ClientIP: p.Client,
-		QName:    strings.TrimSuffix(p.QName, "."),
-		QType:    p.QType,
-		RCode:    p.RespRCode,
-		Elapsed:  dur.Microseconds(),
-		Time:     c.parseTime(text),
-	}
-}
-
-func (c *Collector) parseTime(line string) time.Time {
-	idx := strings.IndexAny(line, "\t ")
-	if idx > 0 {
-		t, err := time.Parse(timeLayout, line[:idx])
-		if err == nil {
-			return t
-		}
-	}
-	return time.Now()
-}
-
 // ============================================================================
 // Cleaner: 数据库维护与日志轮转
 // ============================================================================
 
 type Cleaner struct {
-	db     *gorm.DB
-	conf   *config.Config
-	ctx    context.Context
-	cancel context.CancelFunc
-	wg     sync.WaitGroup
+	db        *gorm.DB
+	conf      *config.Config
+	collector *Collector
+	rollups   *Rollups
+	retention retentionState
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
 }
 
-func NewCleaner(db *gorm.DB, conf *config.Config) *Cleaner {
+func NewCleaner(db *gorm.DB, conf *config.Config, collector *Collector) *Cleaner {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Cleaner{
-		db:     db,
-		conf:   conf,
-		ctx:    ctx,
-		cancel: cancel,
+		db:        db,
+		conf:      conf,
+		collector: collector,
+		rollups:   NewRollups(db, conf),
+		ctx:       ctx,
+		cancel:    cancel,
 	}
 }
 
 func (c *Cleaner) Start() {
 	c.optimizeDB()
 
-	c.wg.Add(3)
+	c.wg.Add(5)
 	go c.runRetention()
 	go c.runLogRotation()
 	go c.runVacuum()
+	go c.runRollup()
+	go c.backfillBaseDomains()
 	slog.Info("Cleaner started")
 }
 
@@ -385,7 +875,7 @@ func (c *Cleaner) runVacuum() {
 	}
 }
 
-// runRetention 定期清理过期数据
+// runRetention 定期清理过期数据，并使数据库不超过 db_max_size_mb
 func (c *Cleaner) runRetention() {
 	defer c.wg.Done()
 	interval := time.Duration(c.conf.DBCheckIntervalMin) * time.Minute
@@ -394,14 +884,18 @@ func (c *Cleaner) runRetention() {
 	}
 
 	doCleanup := func() {
-		days := c.conf.DBRetentionDays
-		if days <= 0 {
-			days = 7
+		// 先聚合，再只删除已计入聚合表的记录
+		if c.rollups.enabled() {
+			c.rollup()
+		}
+		scope, err := c.retentionScope()
+		if err != nil {
+			slog.Error("Retention cleanup query failed", "error", err)
+			return
 		}
-		deadline := time.Now().AddDate(0, 0, -days)
 
-		const batchSize = 1000
-		totalDeleted := 0
+		run := RetentionRun{Reason: RetentionAge, StartedAt: time.Now()}
+		deadline := run.StartedAt.AddDate(0, 0, -c.retentionDays())
 
 		for {
 			select {
@@ -411,9 +905,9 @@ func (c *Cleaner) runRetention() {
 			}
 
 			var ids []uint
-			err := c.db.Model(&model.QueryLog{}).
+			err := scope.
 				Where("time < ?", deadline).
-				Limit(batchSize).
+				Limit(retentionBatch).
 				Pluck("id", &ids).Error
 
 			if err != nil {
@@ -425,18 +919,25 @@ func (c *Cleaner) runRetention() {
 				break
 			}
 
-			if err := c.db.Delete(&model.QueryLog{}, ids).Error; err != nil {
+			n, err := deleteLogs(c.db, ids)
+			if err != nil {
 				slog.Error("Retention batch delete failed", "error", err)
 				break
 			}
 
-			totalDeleted += len(ids)
+			run.DeletedRows += n
 			time.Sleep(50 * time.Millisecond)
 		}
 
-		if totalDeleted > 0 {
-			slog.Info("Retention cleanup finished", "deleted_rows", totalDeleted)
+		if run.DeletedRows > 0 {
+			run.DurationMs = float64(time.Since(run.StartedAt)) / float64(time.Millisecond)
+			c.retention.record(run)
+			slog.Info("Retention cleanup finished", "reason", RetentionAge, "deleted_rows", run.DeletedRows)
 		}
+
+		// 按时间清理之后仍超出空间上限时，再删除最旧的记录
+		c.enforceMaxSize(scope)
+		c.retention.checked(time.Now())
 	}
 
 	ticker := time.NewTicker(interval)
@@ -451,7 +952,7 @@ func (c *Cleaner) runRetention() {
 	}
 }
 
-// runLogRotation 检查日志文件大小并执行 Truncate
+// runLogRotation 检查日志文件大小，超限时通过 Collector 在数据入库后归档并截断
 func (c *Cleaner) runLogRotation() {
 	defer c.wg.Done()
 	interval := time.Duration(c.conf.LogCheckIntervalMin) * time.Minute
@@ -461,6 +962,9 @@ func (c *Cleaner) runLogRotation() {
 
 	// 转换为字节
 	maxSize := int64(c.conf.LogMaxSizeMB) * 1024 * 1024
+	archive := c.conf.LogRotateMode == config.RotateArchive
+	keep := c.conf.LogArchiveKeep
+	maxAge := time.Duration(c.conf.LogArchiveMaxAgeDays) * 24 * time.Hour
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
@@ -469,24 +973,40 @@ func (c *Cleaner) runLogRotation() {
 		case <-c.ctx.Done():
 			return
 		case <-ticker.C:
-			if c.conf.LogPath == "" {
-				continue
-			}
+			for _, src := range c.conf.Sources() {
+				if src.Path == "" {
+					continue
+				}
 
-			fi, err := os.Stat(c.conf.LogPath)
-			if err != nil {
-				continue
-			}
+				fi, err := os.Stat(src.Path)
+				if err != nil {
+					continue
+				}
 
-			if fi.Size() > maxSize {
-				slog.Info("Log file size limit reached. Truncating...",
-					"size", fi.Size(),
-					"limit", maxSize)
+				if fi.Size() > maxSize {
+					slog.Info("Log file size limit reached. Rotating...",
+						"source", src.Name,
+						"mode", c.conf.LogRotateMode,
+						"size", fi.Size(),
+						"limit", maxSize)
+
+					var ra *rotateArchive
+					if archive {
+						path := src.Path
+						ra = &rotateArchive{
+							create: func() (int64, error) { return archiveLog(path, keep) },
+							append: func(data []byte) error { return appendArchive(path, data) },
+						}
+					}
+					if err := c.collector.RotateSource(src.Path, ra); err != nil {
+						slog.Error("Failed to rotate log file", "source", src.Name, "error", err)
+					}
+				}
 
-				if err := os.Truncate(c.conf.LogPath, 0); err != nil {
-					slog.Error("Failed to truncate log file", "error", err)
+				if archive {
+					pruneArchives(src.Path, keep, maxAge)
 				}
 			}
 		}
 	}
-}
\ No newline at end of file
+}
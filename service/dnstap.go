@@ -0,0 +1,310 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	framestream "github.com/farsightsec/golang-framestream"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+	"mosdns-log/config"
+	"mosdns-log/model"
+)
+
+const (
+	// dnstapSourceName 发送方未设置 identity 且无法取得地址时使用的来源名
+	dnstapSourceName = "dnstap"
+	// dnstapHandshakeTimeout Frame Streams 握手及控制帧的读写超时
+	dnstapHandshakeTimeout = 5 * time.Second
+	dnstapMaxPending       = 8192
+	dnstapPendingTTL       = 30 * time.Second
+)
+
+// dnstapReceiver 通过 Frame Streams 协议接收 mosdns、CoreDNS、Unbound 等发送的 dnstap 数据
+type dnstapReceiver struct {
+	conf config.DnstapConfig
+	rows chan *model.QueryLog
+
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	pending map[dnstapKey]time.Time // 尚未收到应答的 CLIENT_QUERY 时间
+}
+
+// dnstapKey 用客户端地址、端口与报文 ID 关联查询与应答
+type dnstapKey struct {
+	addr string
+	port uint32
+	id   uint16
+}
+
+func newDnstapReceiver(conf config.DnstapConfig) *dnstapReceiver {
+	if conf.Network == "" {
+		conf.Network = "unix"
+	}
+	return &dnstapReceiver{
+		conf:    conf,
+		rows:    make(chan *model.QueryLog, rowQueue),
+		conns:   make(map[net.Conn]struct{}),
+		pending: make(map[dnstapKey]time.Time),
+	}
+}
+
+// startDnstap 启动 dnstap 监听以及负责攒批的 rowWorker
+func (c *Collector) startDnstap() {
+	r := c.dnstap
+
+	if r.conf.Network == "unix" {
+		// 清理上次运行遗留的套接字文件，其他类型的文件不做处理
+		if fi, err := os.Lstat(r.conf.Listen); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(r.conf.Listen)
+		}
+	}
+	ln, err := net.Listen(r.conf.Network, r.conf.Listen)
+	if err != nil {
+		slog.Error("Failed to listen dnstap", "network", r.conf.Network, "addr", r.conf.Listen, "error", err)
+		return
+	}
+
+	c.wg.Add(1)
+	go c.dnstapAccept(ln)
+
+	c.producers.Add(1)
+	go c.rowWorker(r.rows)
+	slog.Info("Dnstap receiver started", "addr", r.conf.Listen, "network", r.conf.Network)
+}
+
+func (c *Collector) dnstapAccept(ln net.Listener) {
+	defer c.wg.Done()
+	r := c.dnstap
+	go func() {
+		<-c.ctx.Done()
+		ln.Close()
+		r.mu.Lock()
+		for conn := range r.conns {
+			conn.Close()
+		}
+		r.mu.Unlock()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+			slog.Error("Dnstap accept failed", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		r.mu.Lock()
+		r.conns[conn] = struct{}{}
+		r.mu.Unlock()
+
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			defer func() {
+				r.mu.Lock()
+				delete(r.conns, conn)
+				r.mu.Unlock()
+				conn.Close()
+			}()
+			c.dnstapConn(conn)
+		}()
+	}
+}
+
+// dnstapConn 完成双向 Frame Streams 握手后逐帧解码 dnstap 消息
+func (c *Collector) dnstapConn(conn net.Conn) {
+	r := c.dnstap
+	reader, err := dnstap.NewReader(conn, &dnstap.ReaderOptions{
+		Bidirectional: true,
+		Timeout:       dnstapHandshakeTimeout,
+	})
+	if err != nil {
+		slog.Warn("Dnstap handshake failed", "remote", conn.RemoteAddr(), "error", err)
+		return
+	}
+
+	// unix 套接字没有对端地址，TCP 连接以对端 IP 作为缺省来源
+	remote := ""
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		remote = addr.IP.String()
+	}
+
+	buf := make([]byte, dnstap.MaxPayloadSize)
+	for {
+		n, err := reader.ReadFrame(buf)
+		if errors.Is(err, framestream.ErrDataFrameTooLarge) {
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && c.ctx.Err() == nil {
+				slog.Debug("Dnstap connection closed", "remote", conn.RemoteAddr(), "error", err)
+			}
+			return
+		}
+
+		var dt dnstap.Dnstap
+		if err := proto.Unmarshal(buf[:n], &dt); err != nil {
+			slog.Debug("Invalid dnstap frame", "error", err)
+			continue
+		}
+		if dt.GetType() != dnstap.Dnstap_MESSAGE {
+			continue
+		}
+		ql := r.handleMessage(dt.GetMessage())
+		if ql == nil {
+			continue
+		}
+
+		switch {
+		case len(dt.GetIdentity()) > 0:
+			ql.Source = string(dt.GetIdentity())
+		case remote != "":
+			ql.Source = remote
+		default:
+			ql.Source = dnstapSourceName
+		}
+		if !c.filter.Keep(ql) {
+			continue
+		}
+		ql.BaseDomain = BaseDomain(ql.QName)
+
+		select {
+		case r.rows <- ql:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// handleMessage 记录 CLIENT_QUERY 的时间，并在 CLIENT_RESPONSE 时生成查询记录。
+// 应答消息通常自带查询时间；没有时使用之前收到的对应 CLIENT_QUERY 计算耗时。
+func (r *dnstapReceiver) handleMessage(m *dnstap.Message) *model.QueryLog {
+	if m == nil {
+		return nil
+	}
+
+	switch m.GetType() {
+	case dnstap.Message_CLIENT_QUERY:
+		msg := m.GetQueryMessage()
+		queryTime := dnstapTime(m.GetQueryTimeSec(), m.GetQueryTimeNsec())
+		if len(msg) < 12 || queryTime.IsZero() {
+			return nil
+		}
+		key := dnstapKey{
+			addr: string(m.GetQueryAddress()),
+			port: m.GetQueryPort(),
+			id:   binary.BigEndian.Uint16(msg),
+		}
+		r.mu.Lock()
+		r.addPending(key, queryTime)
+		r.mu.Unlock()
+		return nil
+
+	case dnstap.Message_CLIENT_RESPONSE:
+		var resp dns.Msg
+		if err := resp.Unpack(m.GetResponseMessage()); err != nil || len(resp.Question) == 0 {
+			return nil
+		}
+
+		queryTime := dnstapTime(m.GetQueryTimeSec(), m.GetQueryTimeNsec())
+		respTime := dnstapTime(m.GetResponseTimeSec(), m.GetResponseTimeNsec())
+		key := dnstapKey{
+			addr: string(m.GetQueryAddress()),
+			port: m.GetQueryPort(),
+			id:   resp.Id,
+		}
+		r.mu.Lock()
+		if t, ok := r.pending[key]; ok {
+			delete(r.pending, key)
+			if queryTime.IsZero() {
+				queryTime = t
+			}
+		}
+		r.mu.Unlock()
+
+		var elapsed int64
+		if !queryTime.IsZero() && respTime.After(queryTime) {
+			elapsed = respTime.Sub(queryTime).Microseconds()
+		}
+		t := respTime
+		if t.IsZero() {
+			t = queryTime
+		}
+		estimated := t.IsZero()
+		if estimated {
+			t = time.Now()
+		}
+
+		q := resp.Question[0]
+		return &model.QueryLog{
+			UQID:     int(resp.Id),
+			ClientIP: dnstapAddr(m.GetQueryAddress()),
+			Protocol: dnstapProtocol(m.GetSocketProtocol()),
+			QName:    strings.TrimSuffix(q.Name, "."),
+			QType:    int(q.Qtype),
+			QClass:   int(q.Qclass),
+			RCode:    resp.Rcode,
+			Elapsed:  elapsed,
+			Time:     t,
+			Answers:  answersFromRRs(resp.Answer),
+
+			TimeEstimated: estimated,
+		}
+	}
+	return nil
+}
+
+// addPending 记录未应答的查询，数量过多时清理过期项；调用方需持有 r.mu
+func (r *dnstapReceiver) addPending(key dnstapKey, t time.Time) {
+	if len(r.pending) >= dnstapMaxPending {
+		deadline := t.Add(-dnstapPendingTTL)
+		for k, v := range r.pending {
+			if v.Before(deadline) {
+				delete(r.pending, k)
+			}
+		}
+		if len(r.pending) >= dnstapMaxPending {
+			r.pending = make(map[dnstapKey]time.Time)
+		}
+	}
+	r.pending[key] = t
+}
+
+// dnstapAddr 返回客户端地址；地址缺失或长度不是 IPv4/IPv6 时返回空字符串，
+// 避免 net.IP.String 输出 "<nil>" 或十六进制
+func dnstapAddr(b []byte) string {
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return ""
+	}
+	return net.IP(b).String()
+}
+
+func dnstapTime(sec uint64, nsec uint32) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+// dnstapProtocol 将 dnstap 的传输协议转换为与 mosdns 日志一致的名称
+func dnstapProtocol(p dnstap.SocketProtocol) string {
+	switch p {
+	case dnstap.SocketProtocol_DOT:
+		return "tls"
+	case dnstap.SocketProtocol_DOH:
+		return "https"
+	}
+	return strings.ToLower(p.String())
+}
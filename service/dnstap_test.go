@@ -0,0 +1,47 @@
+package service
+
+import (
+	"net"
+	"testing"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+	"mosdns-log/config"
+)
+
+func TestDnstapClientAddress(t *testing.T) {
+	var resp dns.Msg
+	resp.SetQuestion("example.com.", dns.TypeA)
+	resp.Response = true
+	wire, err := resp.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		addr []byte
+		want string
+	}{
+		{"ipv4", net.ParseIP("192.168.1.2").To4(), "192.168.1.2"},
+		{"ipv6", net.ParseIP("2001:db8::1"), "2001:db8::1"},
+		{"missing", nil, ""},
+		{"truncated", []byte{192, 168}, ""},
+	}
+	for _, tc := range cases {
+		r := newDnstapReceiver(config.DnstapConfig{})
+		ql := r.handleMessage(&dnstap.Message{
+			Type:            dnstap.Message_CLIENT_RESPONSE.Enum(),
+			QueryAddress:    tc.addr,
+			ResponseMessage: wire,
+			ResponseTimeSec: proto.Uint64(1693108800),
+		})
+		if ql == nil {
+			t.Fatalf("%s: no record", tc.name)
+		}
+		if ql.ClientIP != tc.want {
+			t.Errorf("%s: ClientIP = %q, want %q", tc.name, ql.ClientIP, tc.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"cmp"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+	"gorm.io/gorm"
+	"mosdns-log/model"
+)
+
+// baseDomainBackfillBatch 回填 base_domain 时每个事务更新的行数
+const baseDomainBackfillBatch = 5000
+
+// BaseDomain 按内置的公共后缀列表返回 name 的可注册域名（eTLD+1），结果为小写、不带末尾的点。
+// name 本身是公共后缀或无法解析（如 localhost）时返回规范化后的 name。
+func BaseDomain(name string) string {
+	name = normalizeDomain(name)
+	if bd, ok := registrableDomain(name); ok {
+		return bd
+	}
+	return name
+}
+
+// registrableDomain 返回已规范化的 name 的 eTLD+1，name 是公共后缀或为空时返回 false
+func registrableDomain(name string) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+	bd, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return "", false
+	}
+	return bd, true
+}
+
+// backfillBaseDomains 为升级前写入、base_domain 为 NULL 的记录补全可注册域名，完成后退出
+func (c *Cleaner) backfillBaseDomains() {
+	defer c.wg.Done()
+
+	total := 0
+	for c.ctx.Err() == nil {
+		var rows []struct {
+			ID    uint
+			QName string
+		}
+		err := c.db.Model(&model.QueryLog{}).Select("id, q_name").
+			Where("base_domain IS NULL").
+			Order("id").
+			Limit(baseDomainBackfillBatch).
+			Find(&rows).Error
+		if err != nil {
+			slog.Error("Base domain backfill query failed", "error", err)
+			return
+		}
+		if len(rows) == 0 {
+			break
+		}
+
+		err = c.db.Transaction(func(tx *gorm.DB) error {
+			for _, r := range rows {
+				if err := tx.Exec("UPDATE query_logs SET base_domain = ? WHERE id = ?", BaseDomain(r.QName), r.ID).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error("Base domain backfill failed", "error", err)
+			return
+		}
+		total += len(rows)
+	}
+	if total > 0 {
+		slog.Info("Base domain backfill finished", "rows", total)
+	}
+}
+
+// DomainNode 是域名层级中的一个节点，Count 为该域名及其所有子域名的查询次数
+type DomainNode struct {
+	Name        string `json:"name"`
+	Count       int64  `json:"count"`
+	HasChildren bool   `json:"has_children"`
+}
+
+// DomainTree 是 Name 下一级的域名及各自的查询次数。Self 为直接查询 Name 本身的次数
+// （Name 为空时包括尚未回填 base_domain 的记录），
+// Others 为超出 limit 未列出的子节点的查询次数合计，Count = Self + 各子节点 + Others。
+type DomainTree struct {
+	Name     string       `json:"name"`
+	Count    int64        `json:"count"`
+	Self     int64        `json:"self"`
+	Others   int64        `json:"others"`
+	Children []DomainNode `json:"children"`
+}
+
+// QueryDomainTree 统计 q 范围内 parent 的下一级域名（parent 为空时为顶级域名），
+// 按查询次数降序返回前 limit 项。parent 不低于可注册域名（如 com、co.uk）时按 base_domain 分组，
+// 否则只扫描 base_domain 相同的记录，两种情况都能使用索引。
+func QueryDomainTree(db *gorm.DB, q RollupQuery, parent string, limit int) (*DomainTree, error) {
+	parent = normalizeDomain(parent)
+	query := db.Model(&model.QueryLog{}).Where(timeWindowSQL, timeWindowArgs(q.Start, q.End)...)
+	if q.Source != "" {
+		query = query.Where("source = ?", q.Source)
+	}
+
+	var rows []struct {
+		Name   string
+		Count  int64
+		Deeper int64 // 比 Name 更深的查询名的次数
+	}
+	if bd, ok := registrableDomain(parent); ok {
+		err := query.Select("lower(q_name) AS name, COUNT(*) AS count, 0 AS deeper").
+			Where("base_domain = ?", bd).
+			Where("(lower(q_name) = ? OR substr(lower(q_name), ?) = ?)", parent, -len(parent)-1, "."+parent).
+			Group("name").
+			Find(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if parent != "" {
+			query = query.Where("(base_domain = ? OR substr(base_domain, ?) = ?)", parent, -len(parent)-1, "."+parent)
+		}
+		err := query.Select("base_domain AS name, COUNT(*) AS count, SUM(lower(q_name) <> base_domain) AS deeper").
+			Group("base_domain").
+			Find(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tree := &DomainTree{Name: parent, Children: []DomainNode{}}
+	children := make(map[string]*DomainNode)
+	for _, r := range rows {
+		tree.Count += r.Count
+		if r.Name == parent {
+			tree.Self += r.Count
+			continue
+		}
+		name := childDomain(r.Name, parent)
+		node, ok := children[name]
+		if !ok {
+			node = &DomainNode{Name: name}
+			children[name] = node
+		}
+		node.Count += r.Count
+		if name != r.Name || r.Deeper > 0 {
+			node.HasChildren = true
+		}
+	}
+
+	for _, n := range children {
+		tree.Children = append(tree.Children, *n)
+	}
+	slices.SortFunc(tree.Children, func(a, b DomainNode) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	if len(tree.Children) > limit {
+		for _, n := range tree.Children[limit:] {
+			tree.Others += n.Count
+		}
+		tree.Children = tree.Children[:limit]
+	}
+	return tree, nil
+}
+
+// childDomain 返回 name 在 parent 下一级的祖先域名，name 必须是 parent 的子域名
+func childDomain(name, parent string) string {
+	rest := name
+	if parent != "" {
+		rest = name[:len(name)-len(parent)-1]
+	}
+	label := rest[strings.LastIndexByte(rest, '.')+1:]
+	if parent == "" {
+		return label
+	}
+	return label + "." + parent
+}
@@ -0,0 +1,248 @@
+package service
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"mosdns-log/config"
+	"mosdns-log/model"
+)
+
+// IngestFilter 在记录入库前按 ingest_rules 丢弃或抽样。nil 表示不过滤。
+type IngestFilter struct {
+	rules []*ingestRule
+}
+
+// ingestRule 是编译后的过滤规则，空条件表示不限制
+type ingestRule struct {
+	name    string
+	action  string
+	sample  uint64
+	sources []string
+	clients []netip.Prefix
+	domains []string // 小写、不带末尾的点
+	regex   *regexp.Regexp
+	qtypes  []int
+	rcodes  []int
+
+	matched atomic.Int64
+	dropped atomic.Int64
+}
+
+// IngestRuleStats 是单条规则的命中统计，计数从进程启动开始累计
+type IngestRuleStats struct {
+	Name    string `json:"name"`
+	Action  string `json:"action"`
+	Sample  int    `json:"sample,omitempty"`
+	Matched int64  `json:"matched"`
+	Dropped int64  `json:"dropped"`
+	Kept    int64  `json:"kept"` // 命中 sample 规则但被抽中保留的记录数
+}
+
+// NewIngestFilter 校验并编译过滤规则，没有规则时返回 nil
+func NewIngestFilter(rules []config.IngestRule) (*IngestFilter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	f := &IngestFilter{}
+	for i, r := range rules {
+		name := r.Name
+		if name == "" {
+			name = "rule-" + strconv.Itoa(i+1)
+		}
+		rule, err := compileIngestRule(name, r)
+		if err != nil {
+			return nil, fmt.Errorf("ingest rule %s: %w", name, err)
+		}
+		f.rules = append(f.rules, rule)
+	}
+	return f, nil
+}
+
+func compileIngestRule(name string, r config.IngestRule) (*ingestRule, error) {
+	rule := &ingestRule{name: name, action: r.Action, sources: r.Sources}
+	switch r.Action {
+	case "", config.RuleDrop:
+		rule.action = config.RuleDrop
+		if r.Sample != 0 {
+			return nil, fmt.Errorf("sample is only valid with action %q", config.RuleSample)
+		}
+	case config.RuleSample:
+		if r.Sample < 2 {
+			return nil, fmt.Errorf("sample must be at least 2, got %d", r.Sample)
+		}
+		rule.sample = uint64(r.Sample)
+	default:
+		return nil, fmt.Errorf("unknown action %q", r.Action)
+	}
+
+	for _, s := range r.Clients {
+		p, err := parseClientPrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		rule.clients = append(rule.clients, p)
+	}
+	for _, d := range r.Domains {
+		d = normalizeDomain(d)
+		if d == "" {
+			return nil, fmt.Errorf("empty domain")
+		}
+		rule.domains = append(rule.domains, d)
+	}
+	if r.DomainRegex != "" {
+		re, err := regexp.Compile(r.DomainRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain_regex: %w", err)
+		}
+		rule.regex = re
+	}
+	for _, s := range r.QTypes {
+		v, err := parseDNSCode(s, dns.StringToType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid qtype %q", s)
+		}
+		rule.qtypes = append(rule.qtypes, v)
+	}
+	for _, s := range r.RCodes {
+		v, err := parseDNSCode(s, dns.StringToRcode)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rcode %q", s)
+		}
+		rule.rcodes = append(rule.rcodes, v)
+	}
+	return rule, nil
+}
+
+// parseClientPrefix 解析 CIDR，单个 IP 视为只包含该地址的前缀
+func parseClientPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid client %q", s)
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid client %q", s)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parseDNSCode 解析类型名或响应码名（不区分大小写），也接受数值
+func parseDNSCode[T ~uint16 | ~int](s string, names map[string]T) (int, error) {
+	s = strings.TrimSpace(s)
+	if v, err := strconv.Atoi(s); err == nil {
+		return v, nil
+	}
+	if v, ok := names[strings.ToUpper(s)]; ok {
+		return int(v), nil
+	}
+	return 0, fmt.Errorf("unknown name %q", s)
+}
+
+func normalizeDomain(d string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+}
+
+// match 判断记录是否满足规则的全部条件，qname 已规范化
+func (r *ingestRule) match(ql *model.QueryLog, qname string) bool {
+	if len(r.sources) > 0 && !slices.Contains(r.sources, ql.Source) {
+		return false
+	}
+	if len(r.qtypes) > 0 && !slices.Contains(r.qtypes, ql.QType) {
+		return false
+	}
+	if len(r.rcodes) > 0 && !slices.Contains(r.rcodes, ql.RCode) {
+		return false
+	}
+	if len(r.clients) > 0 {
+		addr, err := netip.ParseAddr(ql.ClientIP)
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+		if !slices.ContainsFunc(r.clients, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+			return false
+		}
+	}
+	if len(r.domains) > 0 && !slices.ContainsFunc(r.domains, func(d string) bool { return domainHasSuffix(qname, d) }) {
+		return false
+	}
+	if r.regex != nil && !r.regex.MatchString(qname) {
+		return false
+	}
+	return true
+}
+
+// domainHasSuffix 判断 name 是否等于 suffix 或是其子域名
+func domainHasSuffix(name, suffix string) bool {
+	if !strings.HasSuffix(name, suffix) {
+		return false
+	}
+	return len(name) == len(suffix) || name[len(name)-len(suffix)-1] == '.'
+}
+
+// sampled 判断 sample 规则是否保留该记录。按记录内容哈希，同一行被重复读取
+// （如从断点恢复或重新导入）时结果相同。
+func (r *ingestRule) sampled(ql *model.QueryLog, qname string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(r.name))
+	h.Write([]byte{0})
+	h.Write([]byte(qname))
+	h.Write([]byte{0})
+	h.Write([]byte(ql.ClientIP))
+	h.Write([]byte{0})
+	h.Write(strconv.AppendInt(nil, ql.Time.UnixNano(), 10))
+	h.Write(strconv.AppendInt([]byte{0}, int64(ql.UQID), 10))
+	return h.Sum64()%r.sample == 0
+}
+
+// Keep 按第一条命中的规则决定记录是否入库，未命中任何规则的记录保留。
+// 调用前 ql.Source 必须已经确定。
+func (f *IngestFilter) Keep(ql *model.QueryLog) bool {
+	if f == nil {
+		return true
+	}
+	qname := normalizeDomain(ql.QName)
+	for _, r := range f.rules {
+		if !r.match(ql, qname) {
+			continue
+		}
+		r.matched.Add(1)
+		if r.action == config.RuleSample && r.sampled(ql, qname) {
+			return true
+		}
+		r.dropped.Add(1)
+		return false
+	}
+	return true
+}
+
+// Stats 按配置顺序返回各规则的命中统计
+func (f *IngestFilter) Stats() []IngestRuleStats {
+	if f == nil {
+		return []IngestRuleStats{}
+	}
+	stats := make([]IngestRuleStats, 0, len(f.rules))
+	for _, r := range f.rules {
+		st := IngestRuleStats{
+			Name:    r.name,
+			Action:  r.action,
+			Sample:  int(r.sample),
+			Matched: r.matched.Load(),
+			Dropped: r.dropped.Load(),
+		}
+		st.Kept = max(st.Matched-st.Dropped, 0)
+		stats = append(stats, st)
+	}
+	return stats
+}
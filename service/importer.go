@@ -0,0 +1,376 @@
+package service
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"gorm.io/gorm"
+	"mosdns-log/model"
+)
+
+// importBatchSize 历史导入每批处理的行数，同时决定去重查询的时间窗口
+const importBatchSize = 500
+
+var ErrImportRunning = errors.New("an import is already running")
+
+// ImportProgress 描述一次导入任务的进度
+type ImportProgress struct {
+	Running     bool      `json:"running"`
+	Source      string    `json:"source"`
+	Format      string    `json:"format"`
+	Files       int       `json:"files"`
+	FilesDone   int       `json:"files_done"`
+	CurrentFile string    `json:"current_file"`
+	TotalBytes  int64     `json:"total_bytes"`
+	Bytes       int64     `json:"bytes"`
+	Lines       int64     `json:"lines"`
+	Inserted    int64     `json:"inserted"`
+	Duplicates  int64     `json:"duplicates"`
+	Unparsed    int64     `json:"unparsed"` // 疑似查询日志但解析失败的行数
+	Filtered    int64     `json:"filtered"` // 被 ingest_rules 丢弃的记录数
+	Error       string    `json:"error,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+}
+
+// Importer 导入历史日志文件（明文、gzip 或 zstd），与已有数据去重后写入数据库
+type Importer struct {
+	db     *gorm.DB
+	filter *IngestFilter
+	ctx    context.Context // 后台任务的上下文，Stop 时取消
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	progress ImportProgress
+	bytes    atomic.Int64
+	lines    atomic.Int64
+	inserted atomic.Int64
+	dups     atomic.Int64
+	unparsed atomic.Int64
+	filtered atomic.Int64
+}
+
+func NewImporter(db *gorm.DB, filter *IngestFilter) *Importer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Importer{db: db, filter: filter, ctx: ctx, cancel: cancel}
+}
+
+// Stop 取消后台导入任务并等待其退出，须在关闭数据库之前调用
+func (im *Importer) Stop() {
+	im.cancel()
+	im.wg.Wait()
+}
+
+// Progress 返回当前（或最近一次）导入任务的进度快照
+func (im *Importer) Progress() ImportProgress {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	p := im.progress
+	p.Bytes = im.bytes.Load()
+	p.Lines = im.lines.Load()
+	p.Inserted = im.inserted.Load()
+	p.Duplicates = im.dups.Load()
+	p.Unparsed = im.unparsed.Load()
+	p.Filtered = im.filtered.Load()
+	return p
+}
+
+// Start 在后台启动导入任务，已有任务运行时返回 ErrImportRunning。任务在 Stop 时取消
+func (im *Importer) Start(patterns []string, source, format string, opts ParserOptions) error {
+	if err := im.ctx.Err(); err != nil {
+		return err
+	}
+	files, parser, err := im.prepare(patterns, format, opts)
+	if err != nil {
+		return err
+	}
+	if err := im.begin(files, source, format); err != nil {
+		return err
+	}
+	im.wg.Add(1)
+	go func() {
+		defer im.wg.Done()
+		im.run(im.ctx, files, source, parser)
+	}()
+	return nil
+}
+
+// Run 同步执行导入任务，用于命令行
+func (im *Importer) Run(ctx context.Context, patterns []string, source, format string, opts ParserOptions) error {
+	files, parser, err := im.prepare(patterns, format, opts)
+	if err != nil {
+		return err
+	}
+	if err := im.begin(files, source, format); err != nil {
+		return err
+	}
+	return im.run(ctx, files, source, parser)
+}
+
+func (im *Importer) prepare(patterns []string, format string, opts ParserOptions) ([]string, Parser, error) {
+	parser, err := NewParser(format, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	files, err := expandImportPatterns(patterns)
+	if err != nil {
+		return nil, nil, err
+	}
+	return files, parser, nil
+}
+
+func (im *Importer) begin(files []string, source, format string) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.progress.Running {
+		return ErrImportRunning
+	}
+
+	var total int64
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			total += fi.Size()
+		}
+	}
+	im.progress = ImportProgress{
+		Running:    true,
+		Source:     source,
+		Format:     format,
+		Files:      len(files),
+		TotalBytes: total,
+		StartedAt:  time.Now(),
+	}
+	im.bytes.Store(0)
+	im.lines.Store(0)
+	im.inserted.Store(0)
+	im.dups.Store(0)
+	im.unparsed.Store(0)
+	im.filtered.Store(0)
+	return nil
+}
+
+func (im *Importer) run(ctx context.Context, files []string, source string, parser Parser) error {
+	slog.Info("Import started", "source", source, "files", len(files))
+
+	var err error
+	for i, f := range files {
+		im.mu.Lock()
+		im.progress.CurrentFile = f
+		im.mu.Unlock()
+
+		if err = im.importFile(ctx, f, source, parser); err != nil {
+			err = fmt.Errorf("%s: %w", f, err)
+			break
+		}
+
+		im.mu.Lock()
+		im.progress.FilesDone = i + 1
+		im.mu.Unlock()
+	}
+
+	im.mu.Lock()
+	im.progress.Running = false
+	im.progress.CurrentFile = ""
+	im.progress.FinishedAt = time.Now()
+	if err != nil {
+		im.progress.Error = err.Error()
+	}
+	im.mu.Unlock()
+
+	p := im.Progress()
+	if err != nil {
+		slog.Error("Import failed", "error", err, "inserted", p.Inserted, "duplicates", p.Duplicates)
+	} else {
+		slog.Info("Import finished", "files", p.Files, "lines", p.Lines, "inserted", p.Inserted, "duplicates", p.Duplicates, "unparsed", p.Unparsed)
+	}
+	return err
+}
+
+// expandImportPatterns 展开通配符，按修改时间从旧到新排序
+func expandImportPatterns(patterns []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var files []string
+	for _, p := range patterns {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %q", p)
+		}
+		for _, m := range matches {
+			if fi, err := os.Stat(m); err != nil || fi.IsDir() || seen[m] {
+				continue
+			}
+			seen[m] = true
+			files = append(files, m)
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no files to import")
+	}
+
+	modTime := func(f string) time.Time {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}
+		}
+		return fi.ModTime()
+	}
+	sort.SliceStable(files, func(i, j int) bool { return modTime(files[i]).Before(modTime(files[j])) })
+	return files, nil
+}
+
+// countingReader 统计已读取的原始（压缩前）字节数
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n.Add(int64(n))
+	return n, err
+}
+
+// openArchive 按文件头识别 gzip / zstd 压缩格式，其余按明文处理
+func openArchive(r io.Reader) (io.Reader, func(), error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	magic, _ := br.Peek(4)
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, func() { zr.Close() }, nil
+	case len(magic) == 4 && magic[0] == 0x28 && magic[1] == 0xb5 && magic[2] == 0x2f && magic[3] == 0xfd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	default:
+		return br, func() {}, nil
+	}
+}
+
+func (im *Importer) importFile(ctx context.Context, path, source string, parser Parser) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, closeFn, err := openArchive(countingReader{r: f, n: &im.bytes})
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	reader := bufio.NewReader(r)
+	batch := make([]*model.QueryLog, 0, importBatchSize)
+	for {
+		line, readErr := reader.ReadString('\n')
+		if len(line) > 0 {
+			im.lines.Add(1)
+			ql, err := parseLine(parser, line)
+			if err != nil && parseReason(err) != ReasonNotQuery {
+				im.unparsed.Add(1)
+			}
+			if ql != nil {
+				ql.Source = source
+				if im.filter.Keep(ql) {
+					ql.BaseDomain = BaseDomain(ql.QName)
+					batch = append(batch, ql)
+				} else {
+					im.filtered.Add(1)
+				}
+			}
+		}
+
+		if len(batch) >= importBatchSize || (readErr != nil && len(batch) > 0) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := im.insertBatch(ctx, source, batch); err != nil {
+				return err
+			}
+			batch = make([]*model.QueryLog, 0, importBatchSize)
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// importKey 标识一条查询记录，用于与库中已有数据去重
+func importKey(l *model.QueryLog) string {
+	return fmt.Sprintf("%d|%d|%s|%s|%d", l.Time.UnixNano(), l.UQID, l.ClientIP, l.QName, l.QType)
+}
+
+// insertBatch 查询同一来源、同一时间窗口内已存在的记录，跳过重复后插入
+func (im *Importer) insertBatch(ctx context.Context, source string, batch []*model.QueryLog) error {
+	minT, maxT := batch[0].Time, batch[0].Time
+	for _, l := range batch[1:] {
+		if l.Time.Before(minT) {
+			minT = l.Time
+		}
+		if l.Time.After(maxT) {
+			maxT = l.Time
+		}
+	}
+
+	// time 以写入时的时区偏移存储为文本，已有记录的偏移可能与本批次不同，
+	// 按 datetime()（UTC，精确到秒，见 SetupTimeIndex）取出窗口内的记录，再按纳秒时间比较
+	var existing []model.QueryLog
+	err := im.db.WithContext(ctx).Model(&model.QueryLog{}).
+		Select("uqid, client_ip, q_name, q_type, time").
+		Where("source = ? AND "+utcTimeSQL+" >= datetime(?) AND "+utcTimeSQL+" <= datetime(?)", source, minT, maxT).
+		Find(&existing).Error
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(existing)+len(batch))
+	for i := range existing {
+		seen[importKey(&existing[i])] = true
+	}
+
+	fresh := batch[:0]
+	for _, l := range batch {
+		k := importKey(l)
+		if seen[k] {
+			im.dups.Add(1)
+			continue
+		}
+		seen[k] = true
+		fresh = append(fresh, l)
+	}
+
+	err = im.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return execRawInsert(tx, fresh)
+	})
+	if err != nil {
+		return err
+	}
+	im.inserted.Add(int64(len(fresh)))
+	return nil
+}
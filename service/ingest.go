@@ -0,0 +1,135 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	json "github.com/goccy/go-json"
+	"mosdns-log/model"
+)
+
+var (
+	// ErrBackpressure 表示 batchChan 已满，调用方应稍后重试
+	ErrBackpressure = errors.New("ingest queue is full")
+	// ErrCollectorStopped 表示采集器已停止，不再接收数据
+	ErrCollectorStopped = errors.New("collector is stopped")
+)
+
+// IngestRecord 是推送接口接受的 JSON 对象，字段与 LogPayload 一致，
+// 另可携带 RFC 3339 格式的 time 与 source
+type IngestRecord struct {
+	LogPayload
+	Time   string `json:"time"`
+	Source string `json:"source"`
+}
+
+// ParseIngestLine 解析推送的一行 NDJSON：JSON 对象按 IngestRecord 处理，
+// JSON 字符串或非 JSON 文本按 mosdns 原始日志行处理。
+// 记录被 ingest_rules 过滤掉时返回 nil, nil。
+func (c *Collector) ParseIngestLine(line []byte, source string) (*model.QueryLog, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil, errors.New("empty line")
+	}
+
+	var ql *model.QueryLog
+	switch line[0] {
+	case '{':
+		var rec IngestRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		if rec.Elapsed != "" {
+			if _, err := time.ParseDuration(rec.Elapsed); err != nil {
+				return nil, fmt.Errorf("invalid elapsed %q", rec.Elapsed)
+			}
+		}
+		t := time.Now()
+		if rec.Time != "" {
+			parsed, err := time.Parse(time.RFC3339Nano, rec.Time)
+			if err != nil {
+				return nil, fmt.Errorf("invalid time %q", rec.Time)
+			}
+			t = parsed
+		}
+		ql = rec.toQueryLog(t)
+		ql.TimeEstimated = rec.Time == ""
+		if rec.Source != "" {
+			source = rec.Source
+		}
+	case '"':
+		var raw string
+		if err := json.Unmarshal(line, &raw); err != nil {
+			return nil, fmt.Errorf("invalid JSON string: %w", err)
+		}
+		var err error
+		if ql, err = parseLine(c.rawParser, raw); err != nil {
+			return nil, err
+		}
+	default:
+		var err error
+		if ql, err = parseLine(c.rawParser, string(line)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateQueryLog(ql); err != nil {
+		return nil, err
+	}
+	ql.Source = source
+	if !c.filter.Keep(ql) {
+		return nil, nil
+	}
+	ql.BaseDomain = BaseDomain(ql.QName)
+	return ql, nil
+}
+
+// IngestRuleStats 返回各条 ingest_rules 的命中统计
+func (c *Collector) IngestRuleStats() []IngestRuleStats {
+	return c.filter.Stats()
+}
+
+func validateQueryLog(ql *model.QueryLog) error {
+	if ql.QName == "" {
+		return errors.New("qname is required")
+	}
+	if strings.ContainsAny(ql.QName, " \t\r\n") {
+		return errors.New("qname contains whitespace")
+	}
+	if _, err := netip.ParseAddr(ql.ClientIP); err != nil {
+		return fmt.Errorf("invalid client %q", ql.ClientIP)
+	}
+	if ql.QType < 0 || ql.QType > 65535 || ql.QClass < 0 || ql.QClass > 65535 {
+		return errors.New("qtype/qclass out of range")
+	}
+	if ql.RCode < 0 || ql.RCode > 4095 {
+		return errors.New("resp_rcode out of range")
+	}
+	if ql.Elapsed < 0 {
+		return errors.New("elapsed must not be negative")
+	}
+	return nil
+}
+
+// Ingest 将一批记录送入 batchChan；队列已满时立即返回 ErrBackpressure 而不阻塞。
+// 推送请求不在 producers 之列，发送时持有 batchMu 的读锁，避免与 Stop 时关闭 batchChan 竞争
+func (c *Collector) Ingest(rows []*model.QueryLog) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	c.batchMu.RLock()
+	defer c.batchMu.RUnlock()
+	if c.batchClosed || c.ctx.Err() != nil {
+		return ErrCollectorStopped
+	}
+	select {
+	case c.batchChan <- &ingestBatch{logs: rows}:
+		return nil
+	default:
+		return ErrBackpressure
+	}
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"gorm.io/gorm"
+	"mosdns-log/model"
+)
+
+const (
+	logInsertColumns    = "source, uqid, client_ip, protocol, server_name, q_name, base_domain, q_type, q_class, r_code, elapsed, time, time_estimated"
+	logInsertCols       = 13
+	answerInsertColumns = "query_id, type, ttl, data, ip_key"
+	answerInsertCols    = 5
+
+	// stmtRows 预编译的多行 INSERT 每次写入的行数，批次末尾不足 stmtRows 的部分逐行写入
+	stmtRows = 16
+)
+
+// appendLogArgs 追加一行的插入参数。BaseDomain 由产生记录的一方（parseTracked、推送、dnstap、导入、
+// spool 重放）计算，这里只读取
+func appendLogArgs(args []interface{}, l *model.QueryLog) []interface{} {
+	return append(args, l.Source, l.UQID, l.ClientIP, l.Protocol, l.ServerName, l.QName, l.BaseDomain, l.QType, l.QClass, l.RCode, l.Elapsed, l.Time, l.TimeEstimated)
+}
+
+func appendAnswerArgs(args []interface{}, queryID uint, a model.QueryAnswer) []interface{} {
+	return append(args, queryID, a.Type, a.TTL, a.Data, a.IPKey)
+}
+
+// preparedInsert 是一张表的预编译 INSERT 语句：多行语句与单行语句各一条，
+// 任意行数的批次都拆成这两种固定形状，避免每个批次重新编译 SQL
+type preparedInsert struct {
+	cols int
+	many *sql.Stmt
+	one  *sql.Stmt
+}
+
+func prepareInsert(db *sql.DB, table, columns string, cols int) (*preparedInsert, error) {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", cols), ", ") + ")"
+	header := "INSERT INTO " + table + " (" + columns + ") VALUES "
+
+	one, err := db.Prepare(header + row)
+	if err != nil {
+		return nil, err
+	}
+	many, err := db.Prepare(header + strings.TrimSuffix(strings.Repeat(row+",", stmtRows), ","))
+	if err != nil {
+		one.Close()
+		return nil, err
+	}
+	return &preparedInsert{cols: cols, many: many, one: one}, nil
+}
+
+// exec 在事务中写入 args（每行 cols 个参数）。ids 非 nil 时按行回填 rowid，
+// 单条多行 INSERT 分配的 rowid 是连续的。
+func (pi *preparedInsert) exec(ctx context.Context, tx *sql.Tx, args []interface{}, ids []int64) error {
+	var many, one *sql.Stmt
+	rows := len(args) / pi.cols
+	for i := 0; i < rows; {
+		n := 1
+		if rows-i >= stmtRows {
+			n = stmtRows
+			if many == nil {
+				many = tx.StmtContext(ctx, pi.many)
+			}
+		} else if one == nil {
+			one = tx.StmtContext(ctx, pi.one)
+		}
+		stmt := one
+		if n > 1 {
+			stmt = many
+		}
+
+		res, err := stmt.ExecContext(ctx, args[i*pi.cols:(i+n)*pi.cols]...)
+		if err != nil {
+			return err
+		}
+		if ids != nil {
+			last, err := res.LastInsertId()
+			if err != nil {
+				return err
+			}
+			for j := 0; j < n; j++ {
+				ids[i+j] = last - int64(n-1-j)
+			}
+		}
+		i += n
+	}
+	return nil
+}
+
+func (pi *preparedInsert) close() {
+	pi.many.Close()
+	pi.one.Close()
+}
+
+// logInserter 使用预编译语句写入查询日志及其应答
+type logInserter struct {
+	logs    *preparedInsert
+	answers *preparedInsert
+}
+
+func newLogInserter(db *gorm.DB) (*logInserter, error) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	logs, err := prepareInsert(sqlDB, "query_logs", logInsertColumns, logInsertCols)
+	if err != nil {
+		return nil, err
+	}
+	answers, err := prepareInsert(sqlDB, "query_answers", answerInsertColumns, answerInsertCols)
+	if err != nil {
+		logs.close()
+		return nil, err
+	}
+	return &logInserter{logs: logs, answers: answers}, nil
+}
+
+// insert 在 gorm 事务 tx 中写入 logs 及其应答
+func (li *logInserter) insert(tx *gorm.DB, logs []*model.QueryLog) error {
+	sqlTx, ok := tx.Statement.ConnPool.(*sql.Tx)
+	if !ok {
+		return errors.New("insert must run inside a transaction")
+	}
+	ctx := tx.Statement.Context
+
+	args := make([]interface{}, 0, len(logs)*logInsertCols)
+	for _, l := range logs {
+		args = appendLogArgs(args, l)
+	}
+	var ids []int64
+	if hasAnswers(logs) {
+		ids = make([]int64, len(logs))
+	}
+	if err := li.logs.exec(ctx, sqlTx, args, ids); err != nil {
+		return err
+	}
+	if ids == nil {
+		return nil
+	}
+
+	args = args[:0]
+	for i, l := range logs {
+		l.ID = uint(ids[i])
+		for _, a := range l.Answers {
+			args = appendAnswerArgs(args, l.ID, a)
+		}
+	}
+	return li.answers.exec(ctx, sqlTx, args, nil)
+}
+
+func (li *logInserter) close() {
+	li.logs.close()
+	li.answers.close()
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"log/slog"
+	"sync/atomic"
+
+	"gorm.io/gorm"
+	"mosdns-log/model"
+)
+
+// memoryTrimFraction 超出空间上限时每轮淘汰的记录比例（分母），至少 memoryTrimMin 条
+const (
+	memoryTrimFraction = 20
+	memoryTrimMin      = 1000
+)
+
+// memoryRing 在内存数据库模式下把 query_logs 当作环形缓冲区：
+// 每批写入后按写入顺序淘汰最旧的记录，使行数与占用空间不超过上限（0 表示不限制）。
+// 删除后释放的页会被之后的写入复用，数据库占用的内存不会继续增长。
+type memoryRing struct {
+	maxRows  int64
+	maxBytes int64
+	evicted  atomic.Int64
+}
+
+// trimMemory 淘汰超出上限的最旧记录，在 dbWorker 中与写入串行执行
+func (c *Collector) trimMemory() {
+	r := c.ring
+	var bounds struct {
+		MinID int64
+		MaxID int64
+	}
+	if err := c.db.Raw("SELECT COALESCE(MIN(id), 0) AS min_id, COALESCE(MAX(id), 0) AS max_id FROM query_logs").Scan(&bounds).Error; err != nil {
+		slog.Error("[DB] Failed to read memory store bounds", "error", err)
+		return
+	}
+	if bounds.MaxID == 0 {
+		return
+	}
+
+	// 写入的 ID 连续递增，按 ID 截断即保留最近写入的 maxRows 条
+	if r.maxRows > 0 && bounds.MaxID-bounds.MinID+1 > r.maxRows {
+		cut := bounds.MaxID - r.maxRows
+		if !c.evictUpTo(cut) {
+			return
+		}
+		bounds.MinID = cut + 1
+	}
+
+	if r.maxBytes <= 0 {
+		return
+	}
+	for bounds.MinID <= bounds.MaxID {
+		used, err := databaseUsedBytes(c.db)
+		if err != nil {
+			slog.Error("[DB] Failed to read memory store size", "error", err)
+			return
+		}
+		if used <= r.maxBytes {
+			return
+		}
+		cut := bounds.MinID + max((bounds.MaxID-bounds.MinID+1)/memoryTrimFraction, memoryTrimMin) - 1
+		if !c.evictUpTo(cut) {
+			return
+		}
+		bounds.MinID = cut + 1
+	}
+}
+
+// evictUpTo 删除 ID 不大于 cut 的记录及其应答
+func (c *Collector) evictUpTo(cut int64) bool {
+	var n int64
+	err := c.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("query_id <= ?", cut).Delete(&model.QueryAnswer{}).Error; err != nil {
+			return err
+		}
+		res := tx.Where("id <= ?", cut).Delete(&model.QueryLog{})
+		n = res.RowsAffected
+		return res.Error
+	})
+	if err != nil {
+		slog.Error("[DB] Failed to evict rows from memory store", "error", err)
+		return false
+	}
+	c.ring.evicted.Add(n)
+	return true
+}
+
+// databaseUsedBytes 返回数据库中已使用的页（不含空闲页）占用的字节数
+func databaseUsedBytes(db *gorm.DB) (int64, error) {
+	var pageCount, freelist, pageSize int64
+	if err := db.Raw("PRAGMA page_count").Scan(&pageCount).Error; err != nil {
+		return 0, err
+	}
+	if err := db.Raw("PRAGMA freelist_count").Scan(&freelist).Error; err != nil {
+		return 0, err
+	}
+	if err := db.Raw("PRAGMA page_size").Scan(&pageSize).Error; err != nil {
+		return 0, err
+	}
+	return (pageCount - freelist) * pageSize, nil
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	"mosdns-log/model"
+)
+
+// lagThreshold 落后超过该时间时状态为 lagging
+const lagThreshold = 30 * time.Second
+
+// collectorMetrics 是采集流水线的计数器，均为原子操作，可在任意 goroutine 中更新
+type collectorMetrics struct {
+	linesRead     atomic.Int64
+	rowsQueued    atomic.Int64 // 送入 batchChan 的记录数
+	rowsInserted  atomic.Int64
+	rowsSpooled   atomic.Int64
+	rowsDead      atomic.Int64 // spool 重放反复失败、移入 dead-letter 文件的记录数
+	batches       atomic.Int64 // 成功写入的批次数
+	insertErrors  atomic.Int64
+	lastInsertAt  atomic.Int64 // UnixNano
+	lastInsertDur atomic.Int64 // 最近一次写入的耗时（纳秒）
+	lastRowTime   atomic.Int64 // 已写入记录中最新的日志时间（UnixNano）
+
+	tails map[string]*tailMetrics // 按来源名，创建后只读
+}
+
+// tailMetrics 是单个日志文件的读取进度
+type tailMetrics struct {
+	path         string
+	offset       atomic.Int64
+	lastLineTime atomic.Int64 // 已读取记录中最新的日志时间（UnixNano）
+	lastReadAt   atomic.Int64 // 最近一次读到新行的时间（UnixNano）
+}
+
+// storeMax 将 v 更新为 a 与 v 中的较大值
+func storeMax(a *atomic.Int64, v int64) {
+	for {
+		old := a.Load()
+		if v <= old || a.CompareAndSwap(old, v) {
+			return
+		}
+	}
+}
+
+// queued 记录送入 batchChan 的一批数据
+func (m *collectorMetrics) queued(n int) {
+	m.rowsQueued.Add(int64(n))
+}
+
+// inserted 记录一次数据库写入的结果
+func (m *collectorMetrics) inserted(logs []*model.QueryLog, dur time.Duration, err error) {
+	if err != nil {
+		m.insertErrors.Add(1)
+		return
+	}
+	m.batches.Add(1)
+	m.rowsInserted.Add(int64(len(logs)))
+	m.lastInsertAt.Store(time.Now().UnixNano())
+	m.lastInsertDur.Store(int64(dur))
+	for _, l := range logs {
+		if !l.TimeEstimated {
+			storeMax(&m.lastRowTime, l.Time.UnixNano())
+		}
+	}
+}
+
+// parsed 记录按读取顺序处理完的一块日志，end 为块末尾的偏移量
+func (t *tailMetrics) parsed(end int64, rows []*model.QueryLog) {
+	t.offset.Store(end)
+	for _, ql := range rows {
+		if !ql.TimeEstimated {
+			storeMax(&t.lastLineTime, ql.Time.UnixNano())
+		}
+	}
+}
+
+// CollectorStatus 是采集器运行状态的快照，计数从进程启动开始累计
+type CollectorStatus struct {
+	// Status 为 healthy 或 lagging
+	Status     string  `json:"status"`
+	LagSeconds float64 `json:"lag_seconds"`
+
+	LinesRead    int64 `json:"lines_read"`
+	RowsParsed   int64 `json:"rows_parsed"`
+	RowsQueued   int64 `json:"rows_queued"`
+	RowsInserted int64 `json:"rows_inserted"`
+	RowsSpooled  int64 `json:"rows_spooled"`
+	// RowsDeadLettered spool 中反复写入失败、移入 dead-letter 文件的记录数
+	RowsDeadLettered int64 `json:"rows_dead_lettered"`
+	Batches          int64 `json:"batches"`
+	InsertErrors     int64 `json:"insert_errors"`
+
+	BatchQueue    int `json:"batch_queue"`
+	BatchQueueCap int `json:"batch_queue_cap"`
+
+	LastInsertAt        *time.Time `json:"last_insert_at"`
+	LastInsertLatencyMs float64    `json:"last_insert_latency_ms"`
+	LastRowTime         *time.Time `json:"last_row_time"`
+
+	SpoolPending bool `json:"spool_pending"`
+	// RowsEvicted 内存数据库模式下因超出上限被淘汰的记录数
+	RowsEvicted int64 `json:"rows_evicted"`
+
+	Sources []TailStatus `json:"sources"`
+}
+
+// TailStatus 是单个日志文件的读取进度。文件已读到末尾时 LagSeconds 为 0，
+// 否则为当前时间与已读取的最新日志时间之差。
+type TailStatus struct {
+	Source       string     `json:"source"`
+	Path         string     `json:"path"`
+	Offset       int64      `json:"offset"`
+	Size         int64      `json:"size"`
+	BytesBehind  int64      `json:"bytes_behind"`
+	LastLineTime *time.Time `json:"last_line_time"`
+	LastReadAt   *time.Time `json:"last_read_at"`
+	LagSeconds   float64    `json:"lag_seconds"`
+}
+
+func unixNanoTime(n int64) *time.Time {
+	if n == 0 {
+		return nil
+	}
+	t := time.Unix(0, n)
+	return &t
+}
+
+// Status 返回采集器的计数器、队列深度与各日志文件的读取进度
+func (c *Collector) Status() CollectorStatus {
+	m := &c.metrics
+	now := time.Now()
+
+	st := CollectorStatus{
+		LinesRead:           m.linesRead.Load(),
+		RowsQueued:          m.rowsQueued.Load(),
+		RowsInserted:        m.rowsInserted.Load(),
+		RowsSpooled:         m.rowsSpooled.Load(),
+		RowsDeadLettered:    m.rowsDead.Load(),
+		Batches:             m.batches.Load(),
+		InsertErrors:        m.insertErrors.Load(),
+		BatchQueue:          len(c.batchChan),
+		BatchQueueCap:       cap(c.batchChan),
+		LastInsertAt:        unixNanoTime(m.lastInsertAt.Load()),
+		LastInsertLatencyMs: float64(m.lastInsertDur.Load()) / float64(time.Millisecond),
+		LastRowTime:         unixNanoTime(m.lastRowTime.Load()),
+		SpoolPending:        c.spool != nil && c.spool.pending(),
+		Sources:             make([]TailStatus, 0, len(c.sources)),
+	}
+	if c.ring != nil {
+		st.RowsEvicted = c.ring.evicted.Load()
+	}
+	for _, n := range c.ParseErrorStats().Parsed {
+		st.RowsParsed += n
+	}
+
+	for _, src := range c.sources {
+		t := m.tails[src.Name]
+		ts := TailStatus{
+			Source:       src.Name,
+			Path:         t.path,
+			Offset:       t.offset.Load(),
+			LastLineTime: unixNanoTime(t.lastLineTime.Load()),
+			LastReadAt:   unixNanoTime(t.lastReadAt.Load()),
+		}
+		if fi, err := os.Stat(t.path); err == nil {
+			ts.Size = fi.Size()
+		}
+		// 文件被截断后 offset 可能暂时大于文件大小
+		ts.BytesBehind = max(ts.Size-ts.Offset, 0)
+		if ts.BytesBehind > 0 && ts.LastLineTime != nil {
+			ts.LagSeconds = max(now.Sub(*ts.LastLineTime).Seconds(), 0)
+		}
+		st.LagSeconds = max(st.LagSeconds, ts.LagSeconds)
+		st.Sources = append(st.Sources, ts)
+	}
+
+	st.Status = "healthy"
+	if st.LagSeconds > lagThreshold.Seconds() || st.SpoolPending || st.BatchQueue >= st.BatchQueueCap*8/10 {
+		st.Status = "lagging"
+	}
+	return st
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"sync"
+	"time"
+
+	"mosdns-log/model"
+)
+
+const (
+	// maxQuarantineLine 写入 parse_errors 表的原始行最大长度
+	maxQuarantineLine = 4096
+	quarantineQueue   = 256
+)
+
+// lineOrigin 描述一行日志的来源，用于解析统计与隔离
+type lineOrigin struct {
+	source string
+	path   string // 日志文件路径，syslog 为 "syslog"
+	offset int64  // 行首在文件中的偏移量
+}
+
+// parseStats 按来源统计解析成功的行数与各失败原因的次数
+type parseStats struct {
+	mu       sync.Mutex
+	parsed   map[string]int64
+	failures map[string]map[string]int64
+	dropped  int64 // 隔离队列已满而未写入 parse_errors 的行数
+}
+
+// ParseErrorStats 是解析统计的快照，计数从进程启动开始累计
+type ParseErrorStats struct {
+	Parsed            map[string]int64            `json:"parsed"`
+	Failures          map[string]map[string]int64 `json:"failures"`
+	QuarantineKeep    int                         `json:"quarantine_keep"`
+	QuarantineDropped int64                       `json:"quarantine_dropped"`
+}
+
+// ParseErrorStats 返回各来源的解析成功数与失败原因计数
+func (c *Collector) ParseErrorStats() ParseErrorStats {
+	st := &c.parseStats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	failures := make(map[string]map[string]int64, len(st.failures))
+	for src, reasons := range st.failures {
+		failures[src] = maps.Clone(reasons)
+	}
+	return ParseErrorStats{
+		Parsed:            maps.Clone(st.parsed),
+		Failures:          failures,
+		QuarantineKeep:    c.quarantineKeep,
+		QuarantineDropped: st.dropped,
+	}
+}
+
+func (st *parseStats) count(source, reason string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if reason == "" {
+		st.parsed[source]++
+		return
+	}
+	m := st.failures[source]
+	if m == nil {
+		m = make(map[string]int64)
+		st.failures[source] = m
+	}
+	m[reason]++
+}
+
+// parseTracked 解析一行日志并记录统计。缺少时间戳时使用 fallback，
+// fallback 也为零值时使用当前时间、标记 TimeEstimated 并计入 no_time。
+// 除 not_query 外的失败行会写入 parse_errors 表（若启用）。
+// 解析成功的记录以 origin.source 为来源，被 ingest_rules 过滤掉时返回 nil。
+func (c *Collector) parseTracked(p Parser, origin lineOrigin, line string, fallback time.Time) *model.QueryLog {
+	ql, err := p.Parse(line)
+	if err != nil {
+		reason := parseReason(err)
+		c.parseStats.count(origin.source, reason)
+		if reason != ReasonNotQuery {
+			c.quarantineLine(origin, reason, err, line)
+		}
+		return nil
+	}
+	if ql == nil {
+		return nil
+	}
+
+	if ql.Time.IsZero() {
+		ql.Time = fallback
+	}
+	if ql.Time.IsZero() {
+		ql.Time = time.Now()
+		ql.TimeEstimated = true
+		c.parseStats.count(origin.source, ReasonNoTime)
+	}
+	c.parseStats.count(origin.source, "")
+
+	ql.Source = origin.source
+	if !c.filter.Keep(ql) {
+		return nil
+	}
+	// 在并行的解析协程中计算，减轻写库协程的负担
+	ql.BaseDomain = BaseDomain(ql.QName)
+	return ql
+}
+
+// quarantineLine 将失败的行放入隔离队列，队列已满时丢弃，不阻塞采集
+func (c *Collector) quarantineLine(origin lineOrigin, reason string, err error, line string) {
+	if c.quarantine == nil {
+		return
+	}
+	if len(line) > maxQuarantineLine {
+		line = line[:maxQuarantineLine]
+	}
+	msg := ""
+	var pe *ParseError
+	if errors.As(err, &pe) && pe.Err != nil {
+		msg = pe.Err.Error()
+	}
+
+	rec := &model.ParseError{
+		Source: origin.source,
+		Path:   origin.path,
+		Offset: origin.offset,
+		Reason: reason,
+		Error:  msg,
+		Line:   line,
+		Time:   time.Now(),
+	}
+	select {
+	case c.quarantine <- rec:
+	default:
+		c.parseStats.mu.Lock()
+		c.parseStats.dropped++
+		c.parseStats.mu.Unlock()
+	}
+}
+
+// quarantineWorker 批量写入 parse_errors，并只保留最近 quarantineKeep 条
+func (c *Collector) quarantineWorker() {
+	defer c.wg.Done()
+
+	var buffer []*model.ParseError
+	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(buffer) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		db := c.db.WithContext(ctx)
+		if err := db.Create(&buffer).Error; err != nil {
+			slog.Error("[DB] Failed to write parse errors", "error", err)
+		} else {
+			err = db.Exec("DELETE FROM parse_errors WHERE id <= (SELECT MAX(id) FROM parse_errors) - ?", c.quarantineKeep).Error
+			if err != nil {
+				slog.Error("[DB] Failed to trim parse errors", "error", err)
+			}
+		}
+		buffer = buffer[:0]
+	}
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			for {
+				select {
+				case pe := <-c.quarantine:
+					buffer = append(buffer, pe)
+				default:
+					flush()
+					return
+				}
+			}
+		case <-ticker.C:
+			flush()
+		case pe := <-c.quarantine:
+			buffer = append(buffer, pe)
+			if len(buffer) >= quarantineQueue {
+				flush()
+			}
+		}
+	}
+}
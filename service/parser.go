@@ -0,0 +1,342 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	json "github.com/goccy/go-json"
+	"github.com/miekg/dns"
+	"mosdns-log/model"
+)
+
+const (
+	HeaderScanLimit = 200
+	timeLayout      = "2006-01-02T15:04:05.000-0700"
+)
+
+// 支持的日志格式，对应配置中的 format
+const (
+	FormatMosdnsX     = "mosdns-x"
+	FormatMosdnsV5    = "mosdns-v5"
+	FormatAdGuardHome = "adguardhome"
+	FormatDnsmasq     = "dnsmasq"
+	FormatCoreDNS     = "coredns"
+	FormatUnbound     = "unbound"
+)
+
+// Parser 将一行日志解析为查询记录，无法产生记录时返回 *ParseError；
+// 返回 (nil, nil) 表示该行已被接受但暂未产生记录（如 dnsmasq 的查询行）。
+// 行内没有可用时间戳时返回记录的 Time 为零值，由调用方填充。
+// 实现必须可以被并发调用。
+type Parser interface {
+	Parse(line string) (*model.QueryLog, error)
+}
+
+// 解析失败的原因
+const (
+	ReasonNotQuery  = "not_query"  // 不是查询日志，如其他模块的日志行
+	ReasonShortLine = "short_line" // 查询日志行被截断
+	ReasonBadJSON   = "bad_json"
+	ReasonBadFields = "bad_fields" // 缺少必要字段或字段值无法识别
+	ReasonNoTime    = "no_time"    // 时间戳缺失或无法解析，已使用接收时间
+)
+
+// ParseError 描述一行日志无法解析的原因
+type ParseError struct {
+	Reason string
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	if e.Err == nil {
+		return e.Reason
+	}
+	return e.Reason + ": " + e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+func parseError(reason string, err error) error {
+	return &ParseError{Reason: reason, Err: err}
+}
+
+// parseReason 返回解析错误的原因，非 *ParseError 的错误归为 bad_fields
+func parseReason(err error) string {
+	var pe *ParseError
+	if errors.As(err, &pe) {
+		return pe.Reason
+	}
+	return ReasonBadFields
+}
+
+var parserFactories = map[string]func(tp *TimeParser) Parser{
+	FormatMosdnsX:     func(tp *TimeParser) Parser { return newMosdnsXParser(tp) },
+	FormatMosdnsV5:    func(tp *TimeParser) Parser { return &mosdnsV5Parser{tp: tp} },
+	FormatAdGuardHome: func(tp *TimeParser) Parser { return &adGuardParser{} },
+	FormatDnsmasq:     func(tp *TimeParser) Parser { return newDnsmasqParser(tp) },
+	FormatCoreDNS:     func(tp *TimeParser) Parser { return &coreDNSParser{tp: tp} },
+	FormatUnbound:     func(tp *TimeParser) Parser { return &unboundParser{tp: tp} },
+}
+
+// ParserOptions 是解析器的时间戳选项，对应配置中的 time_layouts / timezone
+type ParserOptions struct {
+	TimeLayouts []string
+	Timezone    string
+}
+
+// NewParser 按格式名创建解析器，空字符串表示 mosdns-x。
+// 有状态的解析器（如 dnsmasq）每个来源应使用独立实例。
+func NewParser(format string, opts ParserOptions) (Parser, error) {
+	if format == "" {
+		format = FormatMosdnsX
+	}
+	factory, ok := parserFactories[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown log format %q (supported: %s)", format, strings.Join(ParserFormats(), ", "))
+	}
+	tp, err := NewTimeParser(opts.TimeLayouts, opts.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	return factory(tp), nil
+}
+
+// ParserFormats 返回所有支持的格式名
+func ParserFormats() []string {
+	formats := make([]string, 0, len(parserFactories))
+	for f := range parserFactories {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// parseLine 解析一行日志，缺少时间戳时使用当前时间并标记 TimeEstimated
+func parseLine(p Parser, line string) (*model.QueryLog, error) {
+	ql, err := p.Parse(line)
+	if ql != nil && ql.Time.IsZero() {
+		ql.Time = time.Now()
+		ql.TimeEstimated = true
+	}
+	return ql, err
+}
+
+func stringToBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
+
+// qtypeFromName 将 "A"、"AAAA"、"TYPE65" 等类型名转换为数值
+func qtypeFromName(s string) int {
+	s = strings.ToUpper(s)
+	if t, ok := dns.StringToType[s]; ok {
+		return int(t)
+	}
+	if n, err := strconv.Atoi(strings.TrimPrefix(s, "TYPE")); err == nil {
+		return n
+	}
+	return 0
+}
+
+// qclassFromName 将 "IN"、"CLASS3" 等类别名转换为数值
+func qclassFromName(s string) int {
+	s = strings.ToUpper(s)
+	if c, ok := dns.StringToClass[s]; ok {
+		return int(c)
+	}
+	if n, err := strconv.Atoi(strings.TrimPrefix(s, "CLASS")); err == nil {
+		return n
+	}
+	return 0
+}
+
+// rcodeFromName 将 "NOERROR"、"NXDOMAIN" 等响应码名称转换为数值，未知名称返回 -1
+func rcodeFromName(s string) int {
+	s = strings.ToUpper(s)
+	if rc, ok := dns.StringToRcode[s]; ok {
+		return rc
+	}
+	if n, err := strconv.Atoi(strings.TrimPrefix(s, "RCODE")); err == nil {
+		return n
+	}
+	return -1
+}
+
+// ============================================================================
+// mosdns-x: "<time>\tinfo\t_query_summary\t...\t{json}"
+// ============================================================================
+
+// LogPayload 用于解析 JSON 日志行
+type LogPayload struct {
+	UQID       int    `json:"uqid"`
+	Client     string `json:"client"`
+	Protocol   string `json:"protocol"`
+	ServerName string `json:"server_name"`
+	QName      string `json:"qname"`
+	QType      int    `json:"qtype"`
+	QClass     int    `json:"qclass"`
+	RespRCode  int    `json:"resp_rcode"`
+	Elapsed    string `json:"elapsed"`
+	// Answers 可选的应答记录，见 payloadAnswer
+	Answers []payloadAnswer `json:"answers"`
+}
+
+func (p *LogPayload) Reset() {
+	p.UQID = 0
+	p.Client = ""
+	p.Protocol = ""
+	p.ServerName = ""
+	p.QName = ""
+	p.QType = 0
+	p.QClass = 0
+	p.RespRCode = 0
+	p.Elapsed = ""
+	p.Answers = nil
+}
+
+// toQueryLog 将解析出的 payload 转换为数据库记录
+func (p *LogPayload) toQueryLog(t time.Time) *model.QueryLog {
+	dur, _ := time.ParseDuration(p.Elapsed)
+
+	return &model.QueryLog{
+		UQID:       p.UQID,
+		ClientIP:   p.Client,
+		Protocol:   p.Protocol,
+		ServerName: p.ServerName,
+		QName:      strings.TrimSuffix(p.QName, "."),
+		QType:      p.QType,
+		QClass:     p.QClass,
+		RCode:      p.RespRCode,
+		Elapsed:    dur.Microseconds(),
+		Time:       t,
+		Answers:    toAnswers(p.Answers),
+	}
+}
+
+type mosdnsXParser struct {
+	tp          *TimeParser
+	payloadPool sync.Pool
+}
+
+func newMosdnsXParser(tp *TimeParser) *mosdnsXParser {
+	return &mosdnsXParser{
+		tp: tp,
+		payloadPool: sync.Pool{
+			New: func() interface{} { return &LogPayload{} },
+		},
+	}
+}
+
+func (mp *mosdnsXParser) Parse(text string) (*model.QueryLog, error) {
+	scanLen := len(text)
+	if scanLen > HeaderScanLimit {
+		scanLen = HeaderScanLimit
+	}
+	if !strings.Contains(text[:scanLen], "_query_summary") {
+		return nil, parseError(ReasonNotQuery, nil)
+	}
+
+	idx := strings.Index(text, "{")
+	if len(text) < 50 || idx == -1 {
+		return nil, parseError(ReasonShortLine, nil)
+	}
+
+	p := mp.payloadPool.Get().(*LogPayload)
+	defer func() {
+		p.Reset()
+		mp.payloadPool.Put(p)
+	}()
+
+	if err := json.Unmarshal(stringToBytes(text[idx:]), p); err != nil {
+		return nil, parseError(ReasonBadJSON, err)
+	}
+	if p.QName == "" {
+		return nil, parseError(ReasonBadFields, errors.New("empty qname"))
+	}
+
+	t, _ := mp.tp.parsePrefix(text)
+	return p.toQueryLog(t), nil
+}
+
+// ============================================================================
+// mosdns v5: query_summary 插件输出，支持控制台格式与 production JSON 格式
+//   2023-08-27T12:00:00.000+0800	info	query_summary	query summary	{"uqid": 1, "client": "...", "qname": "...", "rcode": 0, "elapsed": "1.2ms"}
+//   {"level":"info","ts":1693108800.123,"logger":"query_summary","msg":"query summary","uqid":1,...}
+// ============================================================================
+
+type mosdnsV5Payload struct {
+	UQID       int             `json:"uqid"`
+	Client     string          `json:"client"`
+	Protocol   string          `json:"protocol"`
+	ServerName string          `json:"server_name"`
+	QName      string          `json:"qname"`
+	QType      int             `json:"qtype"`
+	QClass     int             `json:"qclass"`
+	RCode      *int            `json:"rcode"`
+	RespRCode  *int            `json:"resp_rcode"`
+	Elapsed    json.RawMessage `json:"elapsed"`
+	Ts         json.RawMessage `json:"ts"`
+	Answers    []payloadAnswer `json:"answers"`
+}
+
+type mosdnsV5Parser struct {
+	tp *TimeParser
+}
+
+func (vp *mosdnsV5Parser) Parse(text string) (*model.QueryLog, error) {
+	idx := strings.Index(text, "{")
+	if idx == -1 || !strings.Contains(text[idx:], `"qname"`) {
+		return nil, parseError(ReasonNotQuery, nil)
+	}
+
+	var p mosdnsV5Payload
+	if err := json.Unmarshal(stringToBytes(text[idx:]), &p); err != nil {
+		return nil, parseError(ReasonBadJSON, err)
+	}
+	if p.QName == "" {
+		return nil, parseError(ReasonBadFields, errors.New("empty qname"))
+	}
+
+	var t time.Time
+	if idx == 0 {
+		t = vp.tp.parseJSON(p.Ts)
+	} else {
+		t, _ = vp.tp.parsePrefix(text)
+	}
+
+	rcode := 0
+	if p.RespRCode != nil {
+		rcode = *p.RespRCode
+	} else if p.RCode != nil {
+		rcode = *p.RCode
+	}
+
+	// zap 的 duration 可能编码为字符串（"1.2ms"）或秒数（0.0012）
+	var elapsed time.Duration
+	if raw := strings.TrimSpace(string(p.Elapsed)); raw != "" {
+		if s, err := strconv.Unquote(raw); err == nil {
+			elapsed, _ = time.ParseDuration(s)
+		} else if f, err := strconv.ParseFloat(raw, 64); err == nil {
+			elapsed = time.Duration(f * float64(time.Second))
+		}
+	}
+
+	return &model.QueryLog{
+		UQID:       p.UQID,
+		ClientIP:   p.Client,
+		Protocol:   p.Protocol,
+		ServerName: p.ServerName,
+		QName:      strings.TrimSuffix(p.QName, "."),
+		QType:      p.QType,
+		QClass:     p.QClass,
+		RCode:      rcode,
+		Elapsed:    elapsed.Microseconds(),
+		Time:       t,
+		Answers:    toAnswers(p.Answers),
+	}, nil
+}
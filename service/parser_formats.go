@@ -0,0 +1,421 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	json "github.com/goccy/go-json"
+	"github.com/miekg/dns"
+	"mosdns-log/model"
+)
+
+// ============================================================================
+// AdGuard Home: querylog.json，每行一个 JSON 对象
+//   {"IP":"192.168.1.2","T":"2023-08-27T12:00:00.123+08:00","QH":"example.com","QT":"A","QC":"IN","CP":"","Answer":"<base64>","Elapsed":1234567}
+// ============================================================================
+
+type adGuardEntry struct {
+	IP      string    `json:"IP"`
+	T       time.Time `json:"T"`
+	QH      string    `json:"QH"`
+	QT      string    `json:"QT"`
+	QC      string    `json:"QC"`
+	CP      string    `json:"CP"`
+	Answer  []byte    `json:"Answer"`
+	Elapsed int64     `json:"Elapsed"` // 纳秒
+}
+
+type adGuardParser struct{}
+
+func (adGuardParser) Parse(text string) (*model.QueryLog, error) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "{") {
+		return nil, parseError(ReasonNotQuery, nil)
+	}
+
+	var e adGuardEntry
+	if err := json.Unmarshal(stringToBytes(text), &e); err != nil {
+		return nil, parseError(ReasonBadJSON, err)
+	}
+	if e.QH == "" {
+		return nil, parseError(ReasonBadFields, errors.New("empty QH"))
+	}
+
+	// 响应码与应答记录取自原始应答报文；报文无法完整解析时退回读取头部（第 4 字节低 4 位）
+	rcode := 0
+	var answers []model.QueryAnswer
+	var msg dns.Msg
+	if err := msg.Unpack(e.Answer); err == nil {
+		rcode = msg.Rcode
+		answers = answersFromRRs(msg.Answer)
+	} else if len(e.Answer) >= 4 {
+		rcode = int(e.Answer[3] & 0x0f)
+	}
+
+	// CP 为空表示普通 DNS（UDP/TCP）
+	protocol := e.CP
+	if protocol == "" {
+		protocol = "dns"
+	}
+
+	return &model.QueryLog{
+		ClientIP: e.IP,
+		Protocol: protocol,
+		QName:    strings.TrimSuffix(e.QH, "."),
+		QType:    qtypeFromName(e.QT),
+		QClass:   qclassFromName(e.QC),
+		RCode:    rcode,
+		Elapsed:  time.Duration(e.Elapsed).Microseconds(),
+		Time:     e.T,
+		Answers:  answers,
+	}, nil
+}
+
+// ============================================================================
+// dnsmasq: log-queries（可选 log-queries=extra）
+//   Aug 27 12:00:00 dnsmasq[123]: query[A] example.com from 192.168.1.2
+//   Aug 27 12:00:00 dnsmasq[123]: reply example.com is 1.2.3.4
+//   Aug 27 12:00:00 dnsmasq[123]: 5 192.168.1.2/45678 query[A] example.com from 192.168.1.2
+// 经 syslog 接收时头部已被去掉，只剩 "query[A] example.com from 192.168.1.2"。
+// 查询与应答分布在多行：记录 query 行，在第一条 reply/cached/config 行时输出。
+// 没有 log-queries=extra 的序号时按域名配对：同名的查询按先后排队，
+// 应答为 IPv4/IPv6 地址时优先配对 A/AAAA 查询。
+// ============================================================================
+
+const (
+	dnsmasqMaxPending = 4096
+	dnsmasqMaxQueue   = 16 // 同一域名最多排队的查询数
+	dnsmasqPendingTTL = 30 * time.Second
+)
+
+type dnsmasqPending struct {
+	ql *model.QueryLog
+	t  time.Time
+}
+
+type dnsmasqParser struct {
+	tp      *TimeParser
+	mu      sync.Mutex
+	pending map[string][]*dnsmasqPending // 按序号或域名排队的未应答查询
+	// lastAnswer 上一行应答的配对键、种类与地址族，同一应答的后续记录行不再配对新的查询
+	lastAnswer string
+}
+
+func newDnsmasqParser(tp *TimeParser) *dnsmasqParser {
+	return &dnsmasqParser{tp: tp, pending: make(map[string][]*dnsmasqPending)}
+}
+
+// sequential 查询与应答需要按行序配对，只能单线程解析
+func (dp *dnsmasqParser) sequential() {}
+
+func (dp *dnsmasqParser) Parse(text string) (*model.QueryLog, error) {
+	text = strings.TrimRight(text, "\r\n")
+	t, ok := parseRFC3164Time(text, dp.tp.Location())
+	if !ok {
+		t, _ = dp.tp.parsePrefix(text)
+	}
+
+	fields := strings.Fields(dnsmasqMessage(text))
+	// log-queries=extra: "<serial> <client>/<port> ..."
+	serial := ""
+	if len(fields) >= 3 && isDigits(fields[0]) && strings.Contains(fields[1], "/") {
+		serial = fields[0]
+		fields = fields[2:]
+	}
+	if len(fields) < 2 {
+		return nil, parseError(ReasonNotQuery, nil)
+	}
+
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	lastAnswer := dp.lastAnswer
+	dp.lastAnswer = ""
+
+	switch {
+	case strings.HasPrefix(fields[0], "query[") && len(fields) >= 4 && fields[2] == "from":
+		qtype := strings.TrimSuffix(strings.TrimPrefix(fields[0], "query["), "]")
+		name := strings.TrimSuffix(fields[1], ".")
+		key := serial
+		if key == "" {
+			key = strings.ToLower(name)
+		}
+		dp.addPending(key, &dnsmasqPending{
+			ql: &model.QueryLog{
+				ClientIP: fields[3],
+				QName:    name,
+				QType:    qtypeFromName(qtype),
+				QClass:   1,
+				Time:     t,
+			},
+			t: t,
+		})
+		return nil, nil
+
+	case len(fields) >= 4 && fields[2] == "is" && isDnsmasqAnswer(fields[0]):
+		key := serial
+		if key == "" {
+			key = strings.ToLower(strings.TrimSuffix(fields[1], "."))
+		}
+		qtype := dnsmasqAnswerType(fields[3])
+		dp.lastAnswer = key + "/" + fields[0] + "/" + strconv.Itoa(qtype)
+		if dp.lastAnswer == lastAnswer {
+			// 同一应答的后续记录行
+			return nil, nil
+		}
+		p := dp.takePending(key, qtype)
+		if p == nil {
+			// 查询行早于本次读取
+			return nil, nil
+		}
+
+		ql := p.ql
+		switch {
+		case strings.HasPrefix(fields[3], "NXDOMAIN"):
+			ql.RCode = 3
+		case strings.HasPrefix(fields[3], "SERVFAIL"):
+			ql.RCode = 2
+		case strings.HasPrefix(fields[3], "REFUSED"):
+			ql.RCode = 5
+		}
+		// dnsmasq 时间戳只有秒级精度
+		if !p.t.IsZero() && !t.IsZero() && t.After(p.t) {
+			ql.Elapsed = t.Sub(p.t).Microseconds()
+		}
+		return ql, nil
+	}
+	// forwarded、validation 等中间过程的日志
+	return nil, parseError(ReasonNotQuery, nil)
+}
+
+// dnsmasqMessage 去掉 "dnsmasq[pid]: " 或 "dnsmasq: " 及其之前的时间戳、主机名。
+// syslog 接收端已去掉这些头部，没有该标签时按整行都是消息处理；
+// 其他程序（如 dnsmasq-dhcp）的日志行不会匹配查询或应答格式，仍归为 not_query
+func dnsmasqMessage(text string) string {
+	const tag = "dnsmasq"
+	for i := 0; ; {
+		j := strings.Index(text[i:], tag)
+		if j < 0 {
+			return text
+		}
+		j += i
+		rest := text[j+len(tag):]
+		if j == 0 || text[j-1] == ' ' {
+			if k := strings.Index(rest, ": "); k == 0 || (k > 0 && k < 16 && rest[0] == '[') {
+				return rest[k+2:]
+			}
+		}
+		i = j + len(tag)
+	}
+}
+
+// addPending 将未应答的查询加入 key 的队列，数量过多时清理过期项
+func (dp *dnsmasqParser) addPending(key string, p *dnsmasqPending) {
+	if len(dp.pending) >= dnsmasqMaxPending {
+		deadline := p.t.Add(-dnsmasqPendingTTL)
+		for k, queue := range dp.pending {
+			// 队列按时间先后排列，只需检查最新的一项
+			if queue[len(queue)-1].t.Before(deadline) {
+				delete(dp.pending, k)
+			}
+		}
+		if len(dp.pending) >= dnsmasqMaxPending {
+			dp.pending = make(map[string][]*dnsmasqPending)
+		}
+	}
+	queue := dp.pending[key]
+	if len(queue) >= dnsmasqMaxQueue {
+		queue = queue[1:]
+	}
+	dp.pending[key] = append(queue, p)
+}
+
+// takePending 取出 key 队列中最早的、类型为 qtype 的查询；qtype 为 0（无法从应答推断）时取最早的查询
+func (dp *dnsmasqParser) takePending(key string, qtype int) *dnsmasqPending {
+	queue := dp.pending[key]
+	for i, p := range queue {
+		if qtype != 0 && p.ql.QType != qtype {
+			continue
+		}
+		if len(queue) == 1 {
+			delete(dp.pending, key)
+		} else {
+			dp.pending[key] = append(queue[:i:i], queue[i+1:]...)
+		}
+		return p
+	}
+	return nil
+}
+
+// dnsmasqAnswerType 按应答内容推断查询类型：IPv4 地址（或 NODATA-IPv4 等）为 A，IPv6 为 AAAA，
+// CNAME、NXDOMAIN 等无法推断时返回 0
+func dnsmasqAnswerType(answer string) int {
+	switch {
+	case strings.HasSuffix(answer, "-IPv4"):
+		return int(dns.TypeA)
+	case strings.HasSuffix(answer, "-IPv6"):
+		return int(dns.TypeAAAA)
+	}
+	addr, err := netip.ParseAddr(answer)
+	switch {
+	case err != nil:
+		return 0
+	case addr.Is4():
+		return int(dns.TypeA)
+	}
+	return int(dns.TypeAAAA)
+}
+
+func isDnsmasqAnswer(kind string) bool {
+	switch kind {
+	case "reply", "cached", "config", "cached-stale":
+		return true
+	}
+	// 来自 hosts 文件的应答以文件路径开头，如 /etc/hosts
+	return strings.HasPrefix(kind, "/")
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// ============================================================================
+// CoreDNS: log 插件默认格式，可带 RFC3339 时间前缀
+//   [INFO] 10.0.0.1:36520 - 55166 "AAAA IN example.org. udp 41 false 1232" NOERROR qr,rd,ra 68 0.000150916s
+// ============================================================================
+
+type coreDNSParser struct {
+	tp *TimeParser
+}
+
+func (cp *coreDNSParser) Parse(text string) (*model.QueryLog, error) {
+	idx := strings.Index(text, "[INFO] ")
+	if idx == -1 {
+		return nil, parseError(ReasonNotQuery, nil)
+	}
+
+	var t time.Time
+	if idx > 0 {
+		t, _ = cp.tp.Parse(text[:idx])
+	}
+
+	rest := text[idx+len("[INFO] "):]
+	q1 := strings.IndexByte(rest, '"')
+	if q1 == -1 {
+		// 其他插件输出的 INFO 日志
+		return nil, parseError(ReasonNotQuery, nil)
+	}
+	q2 := strings.IndexByte(rest[q1+1:], '"')
+	if q2 == -1 {
+		return nil, parseError(ReasonShortLine, nil)
+	}
+	q2 += q1 + 1
+
+	head := strings.Fields(rest[:q1])        // remote - id
+	query := strings.Fields(rest[q1+1 : q2]) // type class name proto size do bufsize
+	tail := strings.Fields(rest[q2+1:])      // rcode flags rsize duration
+	if len(head) < 1 || len(query) < 4 || len(tail) < 4 {
+		return nil, parseError(ReasonShortLine, nil)
+	}
+
+	client := head[0]
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	uqid := 0
+	if len(head) >= 3 {
+		uqid, _ = strconv.Atoi(head[2])
+	}
+
+	rcode := rcodeFromName(tail[0])
+	if rcode < 0 {
+		return nil, parseError(ReasonBadFields, fmt.Errorf("unknown rcode %q", tail[0]))
+	}
+	dur, _ := time.ParseDuration(tail[3])
+
+	return &model.QueryLog{
+		UQID:     uqid,
+		ClientIP: client,
+		Protocol: query[3],
+		QName:    strings.TrimSuffix(query[2], "."),
+		QType:    qtypeFromName(query[0]),
+		QClass:   qclassFromName(query[1]),
+		RCode:    rcode,
+		Elapsed:  dur.Microseconds(),
+		Time:     t,
+	}, nil
+}
+
+// ============================================================================
+// Unbound: log-replies，时间戳为 "[epoch]" 或 log-time-ascii 格式
+//   [1693108800] unbound[123:0] reply: 192.168.1.2 example.com. A IN NOERROR 0.000123 0 45
+// ============================================================================
+
+type unboundParser struct {
+	tp *TimeParser
+}
+
+func (up *unboundParser) Parse(text string) (*model.QueryLog, error) {
+	head, body, ok := strings.Cut(text, " reply: ")
+	if !ok || !strings.Contains(head, "unbound") {
+		return nil, parseError(ReasonNotQuery, nil)
+	}
+
+	var t time.Time
+	if strings.HasPrefix(head, "[") {
+		if end := strings.IndexByte(head, ']'); end > 1 {
+			if sec, err := strconv.ParseInt(head[1:end], 10, 64); err == nil {
+				t = time.Unix(sec, 0)
+			}
+		}
+	} else if parsed, ok := parseRFC3164Time(head, up.tp.Location()); ok {
+		t = parsed
+	} else {
+		t, _ = up.tp.parsePrefix(head)
+	}
+
+	// client qname type class rcode [time cached size]
+	fields := strings.Fields(body)
+	if len(fields) < 5 {
+		return nil, parseError(ReasonShortLine, nil)
+	}
+
+	client := fields[0]
+	if i := strings.IndexAny(client, "@#"); i > 0 {
+		client = client[:i]
+	}
+	rcode := rcodeFromName(fields[4])
+	if rcode < 0 {
+		return nil, parseError(ReasonBadFields, fmt.Errorf("unknown rcode %q", fields[4]))
+	}
+
+	var elapsed int64
+	if len(fields) >= 6 {
+		if sec, err := strconv.ParseFloat(fields[5], 64); err == nil {
+			elapsed = int64(sec * 1e6)
+		}
+	}
+
+	return &model.QueryLog{
+		ClientIP: client,
+		QName:    strings.TrimSuffix(fields[1], "."),
+		QType:    qtypeFromName(fields[2]),
+		QClass:   qclassFromName(fields[3]),
+		RCode:    rcode,
+		Elapsed:  elapsed,
+		Time:     t,
+	}, nil
+}
@@ -0,0 +1,263 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"mosdns-log/model"
+)
+
+func TestParsers(t *testing.T) {
+	cases := []struct {
+		name   string
+		format string
+		lines  []string // 只检查最后一行的结果，前面的行用于有状态的解析器（dnsmasq）
+		want   model.QueryLog
+		// anyTime 为 true 时不检查时间（如不带年份的 RFC 3164 时间戳）
+		anyTime bool
+	}{
+		{
+			name:   "mosdns-x",
+			format: FormatMosdnsX,
+			lines: []string{"2023-08-27T12:00:00.123+0800\tinfo\t_query_summary\tquery summary\t" +
+				`{"uqid": 7, "client": "192.168.1.2", "protocol": "udp", "server_name": "main", "qname": "example.com.", "qtype": 1, "qclass": 1, "resp_rcode": 0, "elapsed": "1.5ms"}`},
+			want: model.QueryLog{UQID: 7, ClientIP: "192.168.1.2", Protocol: "udp", ServerName: "main", QName: "example.com",
+				QType: 1, QClass: 1, Elapsed: 1500, Time: time.Date(2023, 8, 27, 4, 0, 0, 123e6, time.UTC)},
+		},
+		{
+			name:   "mosdns-v5 console",
+			format: FormatMosdnsV5,
+			lines: []string{"2023-08-27T12:00:00.123+0800\tinfo\tquery_summary\tquery summary\t" +
+				`{"uqid": 1, "client": "192.168.1.2", "qname": "example.com.", "qtype": 28, "qclass": 1, "rcode": 3, "elapsed": "2ms"}`},
+			want: model.QueryLog{UQID: 1, ClientIP: "192.168.1.2", QName: "example.com", QType: 28, QClass: 1, RCode: 3,
+				Elapsed: 2000, Time: time.Date(2023, 8, 27, 4, 0, 0, 123e6, time.UTC)},
+		},
+		{
+			name:   "mosdns-v5 json",
+			format: FormatMosdnsV5,
+			lines: []string{`{"level":"info","ts":1693108800.5,"logger":"query_summary","msg":"query summary",` +
+				`"uqid":2,"client":"10.0.0.1","qname":"example.org.","qtype":1,"qclass":1,"rcode":0,"elapsed":0.0012}`},
+			want: model.QueryLog{UQID: 2, ClientIP: "10.0.0.1", QName: "example.org", QType: 1, QClass: 1,
+				Elapsed: 1200, Time: time.Unix(1693108800, 5e8)},
+		},
+		{
+			name:   "adguardhome",
+			format: FormatAdGuardHome,
+			// Answer 为只有头部的 NXDOMAIN 应答
+			lines: []string{`{"IP":"192.168.1.2","T":"2023-08-27T12:00:00.123+08:00","QH":"example.com","QT":"AAAA","QC":"IN","CP":"doh","Answer":"EjSBgwAAAAAAAAAA","Elapsed":1234567}`},
+			want: model.QueryLog{ClientIP: "192.168.1.2", Protocol: "doh", QName: "example.com", QType: 28, QClass: 1, RCode: 3,
+				Elapsed: 1234, Time: time.Date(2023, 8, 27, 4, 0, 0, 123e6, time.UTC)},
+		},
+		{
+			name:   "dnsmasq",
+			format: FormatDnsmasq,
+			lines: []string{
+				"Aug 27 12:00:00 dnsmasq[123]: query[A] example.com from 192.168.1.2",
+				"Aug 27 12:00:00 dnsmasq[123]: forwarded example.com to 8.8.8.8",
+				"Aug 27 12:00:01 dnsmasq[123]: reply example.com is 1.2.3.4",
+			},
+			want:    model.QueryLog{ClientIP: "192.168.1.2", QName: "example.com", QType: 1, QClass: 1, Elapsed: 1e6},
+			anyTime: true,
+		},
+		{
+			name:   "dnsmasq log-queries=extra",
+			format: FormatDnsmasq,
+			lines: []string{
+				"Aug 27 12:00:00 router dnsmasq[123]: 5 192.168.1.2/45678 query[AAAA] example.com from 192.168.1.2",
+				"Aug 27 12:00:00 router dnsmasq[123]: 5 192.168.1.2/45678 reply example.com is NXDOMAIN",
+			},
+			want:    model.QueryLog{ClientIP: "192.168.1.2", QName: "example.com", QType: 28, QClass: 1, RCode: 3},
+			anyTime: true,
+		},
+		{
+			// syslog 接收端已去掉时间戳与 "dnsmasq[pid]:" 标签，时间由 syslog 头部补上
+			name:   "dnsmasq via syslog",
+			format: FormatDnsmasq,
+			lines: []string{
+				"query[A] dnsmasq.example.com from 192.168.1.3",
+				"cached dnsmasq.example.com is 1.2.3.4",
+			},
+			want: model.QueryLog{ClientIP: "192.168.1.3", QName: "dnsmasq.example.com", QType: 1, QClass: 1},
+		},
+		{
+			name:   "coredns",
+			format: FormatCoreDNS,
+			lines:  []string{`2023-08-27T04:00:00.000Z [INFO] 10.0.0.1:36520 - 55166 "AAAA IN example.org. udp 41 false 1232" NXDOMAIN qr,rd,ra 68 0.000150916s`},
+			want: model.QueryLog{UQID: 55166, ClientIP: "10.0.0.1", Protocol: "udp", QName: "example.org", QType: 28, QClass: 1,
+				RCode: 3, Elapsed: 150, Time: time.Date(2023, 8, 27, 4, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:   "unbound",
+			format: FormatUnbound,
+			lines:  []string{"[1693108800] unbound[123:0] reply: 192.168.1.2 example.com. A IN NOERROR 0.000123 0 45"},
+			want: model.QueryLog{ClientIP: "192.168.1.2", QName: "example.com", QType: 1, QClass: 1,
+				Elapsed: 123, Time: time.Unix(1693108800, 0)},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := NewParser(tc.format, ParserOptions{Timezone: "UTC"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got *model.QueryLog
+			for _, line := range tc.lines {
+				if got, err = p.Parse(line); err != nil && parseReason(err) != ReasonNotQuery {
+					t.Fatalf("Parse(%q): %v", line, err)
+				}
+			}
+			if got == nil {
+				t.Fatalf("no record from %q (err %v)", tc.lines[len(tc.lines)-1], err)
+			}
+
+			if !tc.anyTime && !got.Time.Equal(tc.want.Time) {
+				t.Errorf("Time = %v, want %v", got.Time, tc.want.Time)
+			}
+			got.Time, tc.want.Time = time.Time{}, time.Time{}
+			got.Answers = nil
+			if !reflect.DeepEqual(*got, tc.want) {
+				t.Errorf("got  %+v\nwant %+v", *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseErrorReasons(t *testing.T) {
+	mosdnsX := "2023-08-27T12:00:00.123+0800\tinfo\t_query_summary\tquery summary\t"
+	cases := []struct {
+		format string
+		line   string
+		reason string
+	}{
+		{FormatMosdnsX, "2023-08-27T12:00:00.123+0800\tinfo\tserver\tstarted", ReasonNotQuery},
+		{FormatMosdnsX, "_query_summary\t{", ReasonShortLine},
+		{FormatMosdnsX, mosdnsX + `{"uqid": 7, "client": "192.168.1.2", "qname": `, ReasonBadJSON},
+		{FormatMosdnsX, mosdnsX + `{"uqid": 7, "client": "192.168.1.2", "qname": ""}`, ReasonBadFields},
+		{FormatMosdnsV5, "2023-08-27T12:00:00.123+0800\tinfo\tserver\tstarted", ReasonNotQuery},
+		{FormatMosdnsV5, `{"qname": "example.com.", "uqid": }`, ReasonBadJSON},
+		{FormatMosdnsV5, `{"qname": "", "uqid": 1}`, ReasonBadFields},
+		{FormatAdGuardHome, "not json", ReasonNotQuery},
+		{FormatAdGuardHome, `{"IP":"192.168.1.2","QH":`, ReasonBadJSON},
+		{FormatAdGuardHome, `{"IP":"192.168.1.2","QH":""}`, ReasonBadFields},
+		{FormatDnsmasq, "Aug 27 12:00:00 dnsmasq[123]: forwarded example.com to 8.8.8.8", ReasonNotQuery},
+		{FormatDnsmasq, "Aug 27 12:00:00 dnsmasq-dhcp[123]: DHCPACK(br0) 192.168.1.2 aa:bb:cc:dd:ee:ff", ReasonNotQuery},
+		{FormatCoreDNS, "[INFO] plugin/reload: Running configuration SHA512 = 1234", ReasonNotQuery},
+		{FormatCoreDNS, `[INFO] 10.0.0.1:36520 - 55166 "AAAA IN example.org. udp 41 false 1232`, ReasonShortLine},
+		{FormatCoreDNS, `[INFO] 10.0.0.1:36520 - 55166 "AAAA IN example.org. udp 41 false 1232" BOGUS qr,rd,ra 68 0.0001s`, ReasonBadFields},
+		{FormatUnbound, "[1693108800] unbound[123:0] info: start of service (unbound 1.17.1).", ReasonNotQuery},
+		{FormatUnbound, "[1693108800] unbound[123:0] reply: 192.168.1.2 example.com.", ReasonShortLine},
+		{FormatUnbound, "[1693108800] unbound[123:0] reply: 192.168.1.2 example.com. A IN BOGUS 0.000123 0 45", ReasonBadFields},
+	}
+
+	for _, tc := range cases {
+		p, err := NewParser(tc.format, ParserOptions{Timezone: "UTC"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ql, err := p.Parse(tc.line)
+		if err == nil {
+			t.Errorf("%s: Parse(%q) = %+v, want %s", tc.format, tc.line, ql, tc.reason)
+			continue
+		}
+		if got := parseReason(err); got != tc.reason {
+			t.Errorf("%s: Parse(%q) reason = %s, want %s (%v)", tc.format, tc.line, got, tc.reason, err)
+		}
+	}
+}
+
+// 行内没有时间戳时使用当前时间并标记 TimeEstimated，采集器据此计入 no_time
+func TestParseLineNoTime(t *testing.T) {
+	p, err := NewParser(FormatCoreDNS, ParserOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	ql, err := parseLine(p, `[INFO] 10.0.0.1:36520 - 1 "A IN example.org. udp 41 false 1232" NOERROR qr,rd,ra 68 0.0001s`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ql.TimeEstimated || ql.Time.Before(before) {
+		t.Errorf("Time = %v, TimeEstimated = %v; want current time, estimated", ql.Time, ql.TimeEstimated)
+	}
+}
+
+// 没有 log-queries=extra 时，同名的 A/AAAA 查询及来自不同客户端的查询按应答的地址族与先后顺序配对
+func TestDnsmasqInterleaved(t *testing.T) {
+	type want struct {
+		client string
+		qtype  int
+		rcode  int
+	}
+	cases := []struct {
+		name  string
+		lines []string
+		want  []want
+	}{
+		{
+			name: "A and AAAA, AAAA answered first",
+			lines: []string{
+				"query[A] example.com from 192.168.1.2",
+				"query[AAAA] example.com from 192.168.1.2",
+				"reply example.com is 2001:db8::1",
+				"reply example.com is 1.2.3.4",
+				"reply example.com is 1.2.3.5",
+			},
+			want: []want{{"192.168.1.2", 28, 0}, {"192.168.1.2", 1, 0}},
+		},
+		{
+			name: "two clients, same name",
+			lines: []string{
+				"query[A] example.com from 192.168.1.2",
+				"query[AAAA] example.com from 192.168.1.3",
+				"query[A] example.com from 192.168.1.4",
+				"reply example.com is 1.2.3.4",
+				"reply example.com is NODATA-IPv6",
+				"cached example.com is 1.2.3.4",
+			},
+			want: []want{{"192.168.1.2", 1, 0}, {"192.168.1.3", 28, 0}, {"192.168.1.4", 1, 0}},
+		},
+		{
+			name: "answer without address family takes the oldest query",
+			lines: []string{
+				"query[AAAA] missing.example.com from 192.168.1.2",
+				"query[A] missing.example.com from 192.168.1.3",
+				"reply missing.example.com is NXDOMAIN",
+				"reply missing.example.com is NXDOMAIN-IPv4",
+			},
+			want: []want{{"192.168.1.2", 28, 3}, {"192.168.1.3", 1, 3}},
+		},
+		{
+			name: "reply of the wrong family does not steal a query",
+			lines: []string{
+				"query[A] example.com from 192.168.1.2",
+				"reply example.com is 2001:db8::1",
+				"reply example.com is 1.2.3.4",
+			},
+			want: []want{{"192.168.1.2", 1, 0}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := NewParser(FormatDnsmasq, ParserOptions{Timezone: "UTC"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []want
+			for _, line := range tc.lines {
+				ql, err := p.Parse(line)
+				if err != nil {
+					t.Fatalf("Parse(%q): %v", line, err)
+				}
+				if ql != nil {
+					got = append(got, want{ql.ClientIP, ql.QType, ql.RCode})
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got  %v\nwant %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	"mosdns-log/config"
+	"mosdns-log/model"
+)
+
+// chunkLines tailWorker 每次交给解析协程的最大行数（不超过 batch_size）
+const chunkLines = 256
+
+// lineChunk 是 tailWorker 读取的一段连续的行。解析协程并行解析各个块，
+// batchWorker 按读取顺序取回结果，因此每个批次的断点都恰好对应批次中的最后一行。
+type lineChunk struct {
+	lines []string
+	start int64 // 第一行在文件中的偏移量
+
+	// 读完这些行之后的文件状态，用于生成断点
+	inode    uint64
+	end      int64
+	lastLine string
+	reopened bool // 文件重新打开或被截断后的第一个块，即使没有行也需要更新断点
+
+	flush bool       // 处理完后立即发送缓存
+	sync  chan error // 非空时处理完后发送缓存，并回传写入结果
+
+	rows []*model.QueryLog
+	done chan struct{} // 解析完成后关闭
+}
+
+// tailPipeline 连接一个来源的 tailWorker、解析协程与 batchWorker：
+//
+//	tailWorker --work--> parseWorker × N
+//	           --ordered--> batchWorker --batchChan--> dbWorker
+//
+// ordered 的容量限制了同时在途的块数，下游变慢时 tailWorker 会阻塞在 submit 上。
+type tailPipeline struct {
+	work     chan *lineChunk
+	ordered  chan *lineChunk
+	finished chan struct{}
+}
+
+// sequentialParser 由依赖行顺序的解析器实现（如 dnsmasq 需要配对查询与应答），
+// 这类解析器只使用一个解析协程
+type sequentialParser interface {
+	Parser
+	sequential()
+}
+
+func (c *Collector) startPipeline(src config.LogSource, parser Parser, tm *tailMetrics) *tailPipeline {
+	workers := c.parseWorkers
+	if _, ok := parser.(sequentialParser); ok {
+		workers = 1
+	}
+	pl := &tailPipeline{
+		work:     make(chan *lineChunk, workers),
+		ordered:  make(chan *lineChunk, workers*2),
+		finished: make(chan struct{}),
+	}
+	for range workers {
+		go c.parseWorker(src, parser, pl.work)
+	}
+	go c.batchWorker(src, tm, pl.ordered, pl.finished)
+	return pl
+}
+
+// submit 按读取顺序提交一个块
+func (pl *tailPipeline) submit(ch *lineChunk) {
+	ch.done = make(chan struct{})
+	pl.ordered <- ch
+	if len(ch.lines) == 0 {
+		close(ch.done)
+		return
+	}
+	pl.work <- ch
+}
+
+// close 在最后一个块提交后调用，等待 batchWorker 把剩余数据送入 batchChan
+func (pl *tailPipeline) close() {
+	close(pl.work)
+	close(pl.ordered)
+	<-pl.finished
+}
+
+// parseWorker 解析块中的每一行，结果按行序保存在块中
+func (c *Collector) parseWorker(src config.LogSource, parser Parser, work <-chan *lineChunk) {
+	for ch := range work {
+		offset := ch.start
+		for _, line := range ch.lines {
+			origin := lineOrigin{source: src.Name, path: src.Path, offset: offset}
+			offset += int64(len(line))
+			if ql := c.parseTracked(parser, origin, strings.TrimRight(line, "\r\n"), time.Time{}); ql != nil {
+				ch.rows = append(ch.rows, ql)
+			}
+		}
+		close(ch.done)
+	}
+}
+
+// batchWorker 按顺序收集解析结果，攒满 batch_size 或每隔 flush_interval 发送给 dbWorker。
+// 批次只在块的边界发送，断点与批次中的数据保持一致。
+func (c *Collector) batchWorker(src config.LogSource, tm *tailMetrics, ordered <-chan *lineChunk, finished chan<- struct{}) {
+	defer close(finished)
+
+	var (
+		buffer = make([]*model.QueryLog, 0, c.batchSize)
+		last   *lineChunk // 最近处理完的块，记录当前的读取位置
+		dirty  bool
+	)
+	ticker := time.NewTicker(c.flushInterval)
+	defer ticker.Stop()
+
+	checkpoint := func() *model.TailCheckpoint {
+		if !c.persist || last == nil {
+			return nil
+		}
+		return &model.TailCheckpoint{
+			Path:      src.Path,
+			Inode:     last.inode,
+			Offset:    last.end,
+			LineSize:  len(last.lastLine),
+			LineHash:  hashLine(stringToBytes(last.lastLine)),
+			UpdatedAt: time.Now(),
+		}
+	}
+
+	// dbWorker 在所有生产者退出后才结束，阻塞发送不会丢失数据
+	send := func(done chan error) {
+		if len(buffer) == 0 && !dirty && done == nil {
+			return
+		}
+		c.batchChan <- &ingestBatch{logs: buffer, checkpoint: checkpoint(), done: done}
+		c.metrics.queued(len(buffer))
+		buffer = make([]*model.QueryLog, 0, c.batchSize)
+		dirty = false
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			send(nil)
+		case ch, ok := <-ordered:
+			if !ok {
+				send(nil)
+				return
+			}
+			<-ch.done
+			buffer = append(buffer, ch.rows...)
+			tm.parsed(ch.end, ch.rows)
+			if len(ch.lines) > 0 || ch.reopened {
+				dirty = c.persist
+			}
+			// 块中的数据已转入 buffer，断点中只需要保留位置信息
+			ch.lines, ch.rows = nil, nil
+			last = ch
+
+			switch {
+			case ch.sync != nil:
+				send(ch.sync)
+			case ch.flush, len(buffer) >= c.batchSize:
+				send(nil)
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"mosdns-log/config"
+	"mosdns-log/model"
+)
+
+func openBenchDB(b *testing.B) *gorm.DB {
+	b.Helper()
+	dsn := filepath.Join(b.TempDir(), "bench.db") + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := db.AutoMigrate(&model.QueryLog{}, &model.QueryAnswer{}, &model.TailCheckpoint{}, &model.ParseError{}); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+func writeBenchLog(b *testing.B, path string, n int) {
+	b.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := bufio.NewWriter(f)
+	start := time.Date(2025, 1, 1, 10, 0, 0, 0, time.FixedZone("", 8*3600))
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(w, "%s\tinfo\t_query_summary\tquery summary\t"+
+			`{"uqid": %d, "client": "192.168.1.%d", "protocol": "udp", "server_name": "", "qname": "host%d.example.com.", "qtype": 1, "qclass": 1, "resp_rcode": 0, "elapsed": "1.5ms"}`+"\n",
+			start.Add(time.Duration(i)*time.Millisecond).Format(timeLayout), i, i%250, i%5000)
+	}
+	if err := w.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	f.Close()
+}
+
+// BenchmarkTailPipeline 测量从日志文件读取、解析到写入数据库的端到端吞吐量，
+// 比较批次大小、解析协程数与预编译语句的影响。解析阶段与改造前单协程做法的对比见 BenchmarkParse。
+func BenchmarkTailPipeline(b *testing.B) {
+	cases := []struct {
+		name     string
+		workers  int
+		batch    int
+		prepared bool
+	}{
+		{"workers=1/batch=100/raw", 1, 100, false},
+		{"workers=1/batch=500", 1, 500, true},
+		{"workers=4/batch=500", 4, 500, true},
+		{"workers=4/batch=1000", 4, 1000, true},
+	}
+	for _, tc := range cases {
+		b.Run(tc.name, func(b *testing.B) {
+			db := openBenchDB(b)
+			path := filepath.Join(b.TempDir(), "mosdns.log")
+			writeBenchLog(b, path, b.N)
+
+			conf := &config.Config{
+				LogPath:         path,
+				BatchSize:       tc.batch,
+				FlushIntervalMs: 1000,
+				ParseWorkers:    tc.workers,
+			}
+			b.ResetTimer()
+
+			c := NewCollector(db, conf, nil)
+			if !tc.prepared {
+				c.inserter.close()
+				c.inserter = nil
+			}
+			c.Start()
+			for c.metrics.rowsInserted.Load() < int64(b.N) {
+				time.Sleep(time.Millisecond)
+			}
+			b.StopTimer()
+			c.Stop()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "lines/s")
+		})
+	}
+}
+
+// BenchmarkParse 只测量解析与攒批（不读文件、不写库）。sequential 是改造前 tailWorker 的做法：
+// 在读取协程中逐行解析并攒批；workers=N 经过解析协程与 batchWorker。
+func BenchmarkParse(b *testing.B) {
+	const batch = 500
+	src := config.LogSource{Name: "bench", Path: "mosdns.log"}
+
+	run := func(b *testing.B, feed func(c *Collector, lines []string)) {
+		path := filepath.Join(b.TempDir(), "mosdns.log")
+		writeBenchLog(b, path, b.N)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		lines := strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+
+		c := &Collector{
+			batchChan:     make(chan *ingestBatch, 200),
+			batchSize:     batch,
+			flushInterval: time.Second,
+			parseStats: parseStats{
+				parsed:   make(map[string]int64),
+				failures: make(map[string]map[string]int64),
+			},
+		}
+		rows := 0
+		drained := make(chan struct{})
+		go func() {
+			for bt := range c.batchChan {
+				rows += len(bt.logs)
+			}
+			close(drained)
+		}()
+
+		b.ResetTimer()
+		feed(c, lines)
+		close(c.batchChan)
+		<-drained
+		b.StopTimer()
+		if rows != b.N {
+			b.Fatalf("parsed %d rows, want %d", rows, b.N)
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "lines/s")
+	}
+
+	b.Run("sequential", func(b *testing.B) {
+		run(b, func(c *Collector, lines []string) {
+			parser := newMosdnsXParser(defaultTimeParser)
+			buffer := make([]*model.QueryLog, 0, batch)
+			var offset int64
+			for _, line := range lines {
+				origin := lineOrigin{source: src.Name, path: src.Path, offset: offset}
+				offset += int64(len(line))
+				if ql := c.parseTracked(parser, origin, strings.TrimRight(line, "\r\n"), time.Time{}); ql != nil {
+					buffer = append(buffer, ql)
+				}
+				if len(buffer) >= batch {
+					c.batchChan <- &ingestBatch{logs: buffer}
+					buffer = make([]*model.QueryLog, 0, batch)
+				}
+			}
+			c.batchChan <- &ingestBatch{logs: buffer}
+		})
+	})
+	for _, workers := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			run(b, func(c *Collector, lines []string) {
+				c.parseWorkers = workers
+				pl := c.startPipeline(src, newMosdnsXParser(defaultTimeParser), &tailMetrics{})
+				var offset int64
+				for len(lines) > 0 {
+					n := min(len(lines), chunkLines)
+					ch := &lineChunk{lines: lines[:n], start: offset}
+					for _, line := range ch.lines {
+						offset += int64(len(line))
+					}
+					ch.end = offset
+					pl.submit(ch)
+					lines = lines[n:]
+				}
+				pl.close()
+			})
+		})
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	logs := make([]*model.QueryLog, 500)
+	for i := range logs {
+		logs[i] = &model.QueryLog{
+			Source: "bench", UQID: i, ClientIP: "192.168.1.1", Protocol: "udp",
+			QName: fmt.Sprintf("host%d.example.com", i), QType: 1, QClass: 1,
+			Elapsed: 1500, Time: time.Now(),
+		}
+	}
+
+	b.Run("raw", func(b *testing.B) {
+		db := openBenchDB(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := db.Transaction(func(tx *gorm.DB) error { return execRawInsert(tx, logs) }); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.N*len(logs))/b.Elapsed().Seconds(), "rows/s")
+	})
+	b.Run("prepared", func(b *testing.B) {
+		db := openBenchDB(b)
+		ins, err := newLogInserter(db)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer ins.close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := db.Transaction(func(tx *gorm.DB) error { return ins.insert(tx, logs) }); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.N*len(logs))/b.Elapsed().Seconds(), "rows/s")
+	})
+}
@@ -0,0 +1,270 @@
+package service
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"mosdns-log/config"
+	"mosdns-log/model"
+)
+
+// 数据清理的原因
+const (
+	RetentionAge  = "age"  // 超出 db_retention_days
+	RetentionSize = "size" // 数据库超出 db_max_size_mb
+)
+
+// retentionBatch 每批删除的记录数，批次之间短暂休眠，避免长时间占用写锁
+const retentionBatch = 1000
+
+// RetentionRun 记录一次删除了记录（或因超出空间上限而触发）的清理
+type RetentionRun struct {
+	Reason      string    `json:"reason"`
+	DeletedRows int64     `json:"deleted_rows"`
+	StartedAt   time.Time `json:"started_at"`
+	DurationMs  float64   `json:"duration_ms"`
+	// SizeBefore、SizeAfter 为清理前后数据库文件与 WAL 的总字节数，仅 size 清理记录
+	SizeBefore int64 `json:"size_before,omitempty"`
+	SizeAfter  int64 `json:"size_after,omitempty"`
+}
+
+// RetentionStatus 是数据清理的状态，计数从进程启动开始累计
+type RetentionStatus struct {
+	RetentionDays int   `json:"retention_days"`
+	MaxSizeBytes  int64 `json:"max_size_bytes"` // 0 表示不限制
+	// SizeBytes 为当前数据库文件与 WAL 的总字节数，memory 模式下为 0
+	SizeBytes int64 `json:"size_bytes"`
+
+	LastCheckAt   *time.Time    `json:"last_check_at"`
+	DeletedByAge  int64         `json:"deleted_by_age"`
+	DeletedBySize int64         `json:"deleted_by_size"`
+	LastAge       *RetentionRun `json:"last_age"`
+	LastSize      *RetentionRun `json:"last_size"`
+}
+
+// retentionState 保存最近的清理结果，供 RetentionStatus 读取
+type retentionState struct {
+	mu            sync.Mutex
+	lastCheckAt   time.Time
+	deletedByAge  int64
+	deletedBySize int64
+	lastAge       *RetentionRun
+	lastSize      *RetentionRun
+}
+
+func (s *retentionState) record(run RetentionRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch run.Reason {
+	case RetentionAge:
+		s.deletedByAge += run.DeletedRows
+		s.lastAge = &run
+	case RetentionSize:
+		s.deletedBySize += run.DeletedRows
+		s.lastSize = &run
+	}
+}
+
+func (s *retentionState) checked(t time.Time) {
+	s.mu.Lock()
+	s.lastCheckAt = t
+	s.mu.Unlock()
+}
+
+// RetentionStatus 返回保留策略、当前数据库大小与最近的清理结果
+func (c *Cleaner) RetentionStatus() RetentionStatus {
+	st := RetentionStatus{
+		RetentionDays: c.retentionDays(),
+		MaxSizeBytes:  c.maxSizeBytes(),
+	}
+	if c.conf.DBMode == config.DBModeFile {
+		st.SizeBytes = databaseFileBytes(c.conf.DBPath)
+	}
+
+	s := &c.retention
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.lastCheckAt.IsZero() {
+		t := s.lastCheckAt
+		st.LastCheckAt = &t
+	}
+	st.DeletedByAge = s.deletedByAge
+	st.DeletedBySize = s.deletedBySize
+	st.LastAge = s.lastAge
+	st.LastSize = s.lastSize
+	return st
+}
+
+func (c *Cleaner) retentionDays() int {
+	if c.conf.DBRetentionDays <= 0 {
+		return 7
+	}
+	return c.conf.DBRetentionDays
+}
+
+// maxSizeBytes 返回 db_max_size_mb 对应的字节数，memory 模式由 memory_max_size_mb 限制，不在此处理
+func (c *Cleaner) maxSizeBytes() int64 {
+	if c.conf.DBMode != config.DBModeFile {
+		return 0
+	}
+	return int64(c.conf.DBMaxSizeMB) * 1024 * 1024
+}
+
+// deleteLogs 删除 ids 对应的记录及其应答，返回删除的记录数
+func deleteLogs(db *gorm.DB, ids []uint) (int64, error) {
+	var n int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("query_id IN ?", ids).Delete(&model.QueryAnswer{}).Error; err != nil {
+			return err
+		}
+		res := tx.Delete(&model.QueryLog{}, ids)
+		n = res.RowsAffected
+		return res.Error
+	})
+	return n, err
+}
+
+// retentionScope 返回可以清理的记录。启用聚合时只包含已计入聚合表的记录，
+// 尚未聚合的小时不会因清理而从趋势统计中缺失
+func (c *Cleaner) retentionScope() (*gorm.DB, error) {
+	q := c.db.Model(&model.QueryLog{})
+	if c.rollups.enabled() {
+		state, err := loadRollupState(c.db)
+		if err != nil {
+			return nil, err
+		}
+		if state == nil {
+			state = &model.RollupState{}
+		}
+		q = q.Where(utcTimeSQL+" < datetime(?) AND id <= ?", state.NextHour.UTC(), state.LastID)
+	}
+	return q.Session(&gorm.Session{}), nil
+}
+
+// enforceMaxSize 在数据库文件与 WAL 超出 db_max_size_mb 时按时间从旧到新分批删除 scope 中的记录，
+// 直到已使用的页与 WAL 合计不超过上限，再用 incremental_vacuum 把空闲页归还给文件系统
+func (c *Cleaner) enforceMaxSize(scope *gorm.DB) {
+	limit := c.maxSizeBytes()
+	if limit <= 0 {
+		return
+	}
+	path := c.conf.DBPath
+	before := databaseFileBytes(path)
+	if before <= limit {
+		return
+	}
+
+	run := RetentionRun{Reason: RetentionSize, StartedAt: time.Now(), SizeBefore: before}
+	slog.Info("Database size limit exceeded, deleting oldest rows", "size", before, "limit", limit)
+
+	// 删除产生的 WAL 在每批之后截断，不计入需要腾出的空间
+	c.checkpointWAL()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		default:
+		}
+
+		used, err := databaseUsedBytes(c.db)
+		if err != nil {
+			slog.Error("Failed to read database size", "error", err)
+			break
+		}
+		if used+walFileBytes(path) <= limit {
+			break
+		}
+
+		var ids []uint
+		if err := scope.Order("time").Limit(retentionBatch).Pluck("id", &ids).Error; err != nil {
+			slog.Error("Size retention query failed", "error", err)
+			break
+		}
+		if len(ids) == 0 {
+			slog.Warn("Database still exceeds db_max_size_mb with no deletable query logs left", "used", used, "limit", limit)
+			break
+		}
+		n, err := deleteLogs(c.db, ids)
+		if err != nil {
+			slog.Error("Size retention batch delete failed", "error", err)
+			break
+		}
+		run.DeletedRows += n
+		c.checkpointWAL()
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := incrementalVacuum(c.db); err != nil {
+		slog.Error("Incremental vacuum failed", "error", err)
+	}
+	c.checkpointWAL()
+
+	run.SizeAfter = databaseFileBytes(path)
+	run.DurationMs = float64(time.Since(run.StartedAt)) / float64(time.Millisecond)
+	c.retention.record(run)
+	slog.Info("Retention cleanup finished", "reason", RetentionSize, "deleted_rows", run.DeletedRows,
+		"size_before", run.SizeBefore, "size_after", run.SizeAfter, "limit", limit)
+}
+
+// incrementalVacuum 释放全部空闲页。每次 step 只释放一页，Exec 只执行一步，因此需要读完所有结果行
+func incrementalVacuum(db *gorm.DB) error {
+	rows, err := db.Raw("PRAGMA incremental_vacuum").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+// checkpointWAL 把 WAL 写回数据库文件并截断，有读事务未结束时可能只完成一部分
+func (c *Cleaner) checkpointWAL() {
+	if err := c.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)").Error; err != nil {
+		slog.Error("WAL checkpoint failed", "error", err)
+	}
+}
+
+// databaseFileBytes 返回数据库文件与 WAL 文件的总字节数
+func databaseFileBytes(path string) int64 {
+	var n int64
+	if fi, err := os.Stat(path); err == nil {
+		n = fi.Size()
+	}
+	return n + walFileBytes(path)
+}
+
+func walFileBytes(path string) int64 {
+	if fi, err := os.Stat(path + "-wal"); err == nil {
+		return fi.Size()
+	}
+	return 0
+}
+
+// SetupIncrementalVacuum 把数据库切换为 auto_vacuum=INCREMENTAL，使 size 清理后能用 incremental_vacuum 缩小文件。
+// 已有的数据库需要一次完整的 VACUUM 才能切换，之后不再重复。
+func SetupIncrementalVacuum(db *gorm.DB) error {
+	var mode int
+	if err := db.Raw("PRAGMA auto_vacuum").Scan(&mode).Error; err != nil {
+		return err
+	}
+	if mode == 2 {
+		return nil
+	}
+	start := time.Now()
+	// PRAGMA 与 VACUUM 须在同一连接上执行
+	err := db.Connection(func(tx *gorm.DB) error {
+		if err := tx.Exec("PRAGMA auto_vacuum = INCREMENTAL").Error; err != nil {
+			return err
+		}
+		return tx.Exec("VACUUM").Error
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("Switched database to incremental auto_vacuum", "duration", time.Since(start))
+	return nil
+}
@@ -0,0 +1,355 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"mosdns-log/config"
+	"mosdns-log/model"
+)
+
+const (
+	rollupInterval = 10 * time.Minute
+	// rollupDelay 小时结束后等待的时间，让仍在批次中的记录先入库
+	rollupDelay = 15 * time.Minute
+)
+
+// 聚合维度
+const (
+	RollupTotal  = "total"
+	RollupDomain = "domain"
+	RollupClient = "client"
+	RollupQType  = "qtype"
+	RollupRCode  = "rcode"
+)
+
+type rollupDim struct{ name, expr string }
+
+// rollupDims 各维度在 query_logs 中对应的分组表达式
+var rollupDims = []rollupDim{
+	{RollupTotal, "''"},
+	{RollupDomain, "q_name"},
+	{RollupClient, "client_ip"},
+	{RollupQType, "CAST(q_type AS TEXT)"},
+	{RollupRCode, "CAST(r_code AS TEXT)"},
+}
+
+const (
+	rollupHistColumns = "lat_1ms, lat_5ms, lat_10ms, lat_50ms, lat_100ms, lat_500ms, lat_1s, lat_inf"
+	rollupColumns     = "bucket, source, dim, key, count, elapsed_sum, " + rollupHistColumns
+
+	// timeWindowSQL 按 UTC 时间筛选 [start, end) 内的记录，使用 SetupTimeIndex 建立的表达式索引
+	timeWindowSQL = utcTimeSQL + " >= datetime(?) AND " + utcTimeSQL + " < datetime(?)"
+)
+
+// SQLiteTimeLayout 是 time.Time 在 SQLite 中的文本存储格式，聚合结果需要手动解析
+const SQLiteTimeLayout = "2006-01-02 15:04:05.999999999-07:00"
+
+func timeWindowArgs(start, end time.Time) []interface{} {
+	return []interface{}{start, end}
+}
+
+// latencyHistogramSQL 返回按 model.RollupLatencyBounds 对 elapsed 分桶计数的表达式列表
+func latencyHistogramSQL() string {
+	parts := make([]string, 0, len(model.RollupLatencyBounds)+1)
+	lower := int64(0)
+	for i, ub := range model.RollupLatencyBounds {
+		if i == 0 {
+			parts = append(parts, fmt.Sprintf("SUM(CASE WHEN elapsed <= %d THEN 1 ELSE 0 END)", ub))
+		} else {
+			parts = append(parts, fmt.Sprintf("SUM(CASE WHEN elapsed > %d AND elapsed <= %d THEN 1 ELSE 0 END)", lower, ub))
+		}
+		lower = ub
+	}
+	parts = append(parts, fmt.Sprintf("SUM(CASE WHEN elapsed > %d THEN 1 ELSE 0 END)", lower))
+	return strings.Join(parts, ", ")
+}
+
+// sumHistogramSQL 返回对聚合表直方图各列求和的表达式列表
+func sumHistogramSQL() string {
+	cols := strings.Split(rollupHistColumns, ", ")
+	for i, col := range cols {
+		cols[i] = "SUM(" + col + ")"
+	}
+	return strings.Join(cols, ", ")
+}
+
+// Rollups 维护按小时、按天聚合的统计表，使趋势数据不受 db_retention_days 限制；
+// 查询时按时间范围组合原始记录与聚合表（见 rollup_query.go）。
+type Rollups struct {
+	db   *gorm.DB
+	conf *config.Config
+	mu   sync.Mutex // 串行化 update，聚合与清理前的聚合可能同时运行
+}
+
+func NewRollups(db *gorm.DB, conf *config.Config) *Rollups {
+	return &Rollups{db: db, conf: conf}
+}
+
+func (r *Rollups) enabled() bool {
+	return r.conf.RollupHourlyDays > 0
+}
+
+// update 补计已聚合的小时中新写入的记录，聚合所有已结束且早于 until 的小时，
+// 汇总已聚合完整的日期，并清理过期的聚合数据
+func (r *Rollups) update(ctx context.Context, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state, err := loadRollupState(r.db)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		// 首次运行时从最早的原始记录开始回填
+		first, err := minRawTime(r.db)
+		if err != nil {
+			return err
+		}
+		if first.IsZero() {
+			return r.prune(time.Now())
+		}
+		state = &model.RollupState{ID: 1, NextHour: first.UTC().Truncate(time.Hour), NextDay: localDay(first).UTC()}
+	}
+
+	// 本轮只计入 ID 不超过 maxID 的记录，之后写入的记录留给下一轮补计，不会重复计数
+	var maxID uint
+	if err := r.db.Raw("SELECT COALESCE(MAX(id), 0) FROM query_logs").Scan(&maxID).Error; err != nil {
+		return err
+	}
+	late, err := r.rollupLate(state, maxID)
+	if err != nil {
+		return fmt.Errorf("rollup late rows: %w", err)
+	}
+
+	hours := 0
+	for h := state.NextHour.UTC(); !h.Add(time.Hour).After(until); h = h.Add(time.Hour) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := r.rollupHour(state, h, maxID); err != nil {
+			return fmt.Errorf("rollup hour %s: %w", h.Format(time.RFC3339), err)
+		}
+		hours++
+	}
+
+	days := 0
+	if r.conf.RollupDailyDays > 0 {
+		if days, err = r.rollupDays(ctx, state); err != nil {
+			return err
+		}
+	}
+	if hours > 0 || days > 0 || late > 0 {
+		slog.Info("Rollup updated", "hours", hours, "days", days, "late_hours", late)
+	}
+	return r.prune(time.Now())
+}
+
+// loadRollupState 读取聚合进度，尚未聚合过时返回 nil
+func loadRollupState(db *gorm.DB) (*model.RollupState, error) {
+	var state model.RollupState
+	res := db.Limit(1).Find(&state)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return nil, res.Error
+	}
+	return &state, nil
+}
+
+// minRawTime 返回 query_logs 中最早的记录时间，表为空时返回零值
+func minRawTime(db *gorm.DB) (time.Time, error) {
+	var s *string
+	if err := db.Raw("SELECT MIN(time) FROM query_logs").Scan(&s).Error; err != nil {
+		return time.Time{}, err
+	}
+	if s == nil {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(SQLiteTimeLayout, *s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse time %q: %w", *s, err)
+	}
+	return t, nil
+}
+
+// rollupSQL 返回将 [start, start+1h) 内 ID 在 (afterID, maxID] 的记录按各维度分组、
+// 累加到 table 中 bucket 的语句。这一小时的记录只经索引读取一次，物化后再按各维度分组。
+func rollupSQL(table string, bucket, start time.Time, afterID, maxID uint) (string, []interface{}) {
+	hist := latencyHistogramSQL()
+	selects := make([]string, 0, len(rollupDims))
+	args := append(timeWindowArgs(start, start.Add(time.Hour)), afterID, maxID)
+	for _, d := range rollupDims {
+		selects = append(selects, "SELECT ?, source, ?, "+d.expr+", COUNT(*), SUM(elapsed), "+hist+
+			" FROM hour GROUP BY source, "+d.expr)
+		args = append(args, bucket, d.name)
+	}
+
+	cols := strings.Split(rollupColumns, ", ")[4:]
+	for i, col := range cols {
+		cols[i] = col + " = " + col + " + excluded." + col
+	}
+	return "INSERT INTO " + table + " (" + rollupColumns + ") " +
+		"WITH hour AS MATERIALIZED (SELECT source, q_name, client_ip, q_type, r_code, elapsed FROM query_logs WHERE " +
+		timeWindowSQL + " AND id > ? AND id <= ?) " +
+		strings.Join(selects, " UNION ALL ") +
+		" ON CONFLICT (bucket, source, dim, key) DO UPDATE SET " + strings.Join(cols, ", "), args
+}
+
+// rollupHour 在一个事务中重新生成 start 所在小时的聚合数据，并将进度推进到下一个小时
+func (r *Rollups) rollupHour(state *model.RollupState, start time.Time, maxID uint) error {
+	sql, args := rollupSQL("rollup_hourly", start, start, 0, maxID)
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("bucket = ?", start).Delete(&model.HourlyRollup{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(sql, args...).Error; err != nil {
+			return err
+		}
+		next := *state
+		next.NextHour = start.Add(time.Hour)
+		if err := tx.Save(&next).Error; err != nil {
+			return err
+		}
+		*state = next
+		return nil
+	})
+}
+
+// rollupLate 将已聚合的小时中后写入的记录（导入回填、spool 重放、落后的 syslog 等）
+// 累加到小时聚合，所在日期已汇总时同时累加到按天聚合，并把 LastID 推进到 maxID。
+// 全部在一个事务中完成，中断后重做不会重复计数。返回补计的小时数。
+func (r *Rollups) rollupLate(state *model.RollupState, maxID uint) (int, error) {
+	afterID := state.LastID
+	if maxID < afterID {
+		afterID = 0
+	}
+	var hours []string
+	if maxID > afterID {
+		if err := r.db.Raw("SELECT DISTINCT strftime('%Y-%m-%d %H:00:00', time) FROM query_logs WHERE id > ? AND id <= ? AND "+
+			utcTimeSQL+" < datetime(?)", afterID, maxID, state.NextHour.UTC()).Scan(&hours).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		for _, s := range hours {
+			h, err := time.ParseInLocation(time.DateTime, s, time.UTC)
+			if err != nil {
+				return fmt.Errorf("parse hour %q: %w", s, err)
+			}
+			sql, args := rollupSQL("rollup_hourly", h, h, afterID, maxID)
+			if err := tx.Exec(sql, args...).Error; err != nil {
+				return err
+			}
+			// 之后的日期由 rollupDays 从小时聚合重新汇总
+			if day := localDay(h).UTC(); r.conf.RollupDailyDays > 0 && day.Before(state.NextDay) {
+				sql, args := rollupSQL("rollup_daily", day, h, afterID, maxID)
+				if err := tx.Exec(sql, args...).Error; err != nil {
+					return err
+				}
+			}
+		}
+		next := *state
+		next.LastID = maxID
+		if err := tx.Save(&next).Error; err != nil {
+			return err
+		}
+		*state = next
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(hours), nil
+}
+
+// localDay 返回 t 所在的服务器本地日期的零点
+func localDay(t time.Time) time.Time {
+	t = t.In(time.Local)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// rollupDays 将小时聚合汇总为按天聚合，只处理所有小时都已聚合的日期
+func (r *Rollups) rollupDays(ctx context.Context, state *model.RollupState) (int, error) {
+	hist := sumHistogramSQL()
+	days := 0
+	day := localDay(state.NextDay)
+	for next := day.AddDate(0, 0, 1); !next.After(state.NextHour); day, next = next, next.AddDate(0, 0, 1) {
+		if err := ctx.Err(); err != nil {
+			return days, err
+		}
+		start := day.UTC()
+		err := r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("bucket = ?", start).Delete(&model.DailyRollup{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("INSERT INTO rollup_daily ("+rollupColumns+") "+
+				"SELECT ?, source, dim, key, SUM(count), SUM(elapsed_sum), "+hist+
+				" FROM rollup_hourly WHERE bucket >= ? AND bucket < ? GROUP BY source, dim, key",
+				start, start, next.UTC()).Error; err != nil {
+				return err
+			}
+			st := *state
+			st.NextDay = next.UTC()
+			if err := tx.Save(&st).Error; err != nil {
+				return err
+			}
+			*state = st
+			return nil
+		})
+		if err != nil {
+			return days, fmt.Errorf("rollup day %s: %w", day.Format(time.DateOnly), err)
+		}
+		days++
+	}
+	return days, nil
+}
+
+// prune 删除超出保留期的聚合数据
+func (r *Rollups) prune(now time.Time) error {
+	hourly := now.AddDate(0, 0, -r.conf.RollupHourlyDays).UTC()
+	if err := r.db.Where("bucket < ?", hourly).Delete(&model.HourlyRollup{}).Error; err != nil {
+		return err
+	}
+	daily := now.AddDate(0, 0, -r.conf.RollupDailyDays).UTC()
+	return r.db.Where("bucket < ?", daily).Delete(&model.DailyRollup{}).Error
+}
+
+// runRollup 定期聚合已结束的小时。采集落后时只聚合已入库的最新记录之前的小时，
+// 以免落后的记录在聚合之后才写入。
+func (c *Cleaner) runRollup() {
+	defer c.wg.Done()
+	if !c.rollups.enabled() {
+		return
+	}
+
+	c.rollup()
+	ticker := time.NewTicker(rollupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.rollup()
+		}
+	}
+}
+
+// rollup 执行一轮聚合。采集落后时只聚合已入库的最新记录之前的小时
+func (c *Cleaner) rollup() {
+	until := time.Now().Add(-rollupDelay)
+	if c.collector != nil {
+		st := c.collector.Status()
+		if st.Status == "lagging" && st.LastRowTime != nil && st.LastRowTime.Before(until) {
+			until = *st.LastRowTime
+		}
+	}
+	if err := c.rollups.update(c.ctx, until); err != nil && c.ctx.Err() == nil {
+		slog.Error("Rollup failed", "error", err)
+	}
+}
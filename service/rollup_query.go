@@ -0,0 +1,267 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"mosdns-log/model"
+)
+
+// RollupQuery 描述一次统计查询，时间范围为 [Start, End)，Source 为空表示全部来源
+type RollupQuery struct {
+	Start  time.Time
+	End    time.Time
+	Source string
+}
+
+// RollupPoint 是时间序列中的一个点，Histogram 按 model.RollupLatencyBounds 分桶
+type RollupPoint struct {
+	Time         time.Time `json:"time"`
+	Count        int64     `json:"count"`
+	AvgLatencyMs float64   `json:"avg_latency_ms"`
+	Histogram    []int64   `json:"histogram"`
+
+	elapsedSum int64
+}
+
+// RollupTop 是某个维度上按查询次数排序的一项
+type RollupTop struct {
+	Key          string  `json:"key"`
+	Count        int64   `json:"count"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+// rollupTiers 按数据来源划分时间轴：rawFrom 之后读原始记录，hourlyFrom 到 rawFrom 读小时聚合，
+// hourlyFrom 之前读按天聚合。未启用聚合时全部读原始记录。
+type rollupTiers struct {
+	rawFrom    time.Time
+	hourlyFrom time.Time
+}
+
+// tiers 计算当前的分界：原始记录从保留期（或最早的记录）之后第一个完整的小时开始，
+// 聚合尚未追上这一点时（新建的数据库、聚合落后）从第一个未聚合的小时开始；
+// 小时聚合从其保留期之后第一个完整的本地日期开始，与按天聚合的边界对齐。
+func (r *Rollups) tiers(now time.Time) rollupTiers {
+	if !r.enabled() {
+		return rollupTiers{}
+	}
+	days := r.conf.DBRetentionDays
+	if days <= 0 {
+		days = 7
+	}
+	rawFrom := now.AddDate(0, 0, -days)
+	first, err := minRawTime(r.db)
+	if err == nil && first.After(rawFrom) {
+		rawFrom = first
+	} else if err == nil && first.IsZero() {
+		rawFrom = now
+	}
+	t := rollupTiers{rawFrom: ceilHour(rawFrom)}
+
+	// 已聚合到的位置；从未聚合过时为最早记录所在的小时
+	var covered time.Time
+	state, err := loadRollupState(r.db)
+	if err == nil && state != nil {
+		covered = state.NextHour
+	} else if err == nil && !first.IsZero() {
+		covered = first.Truncate(time.Hour)
+	}
+	if !covered.IsZero() && covered.Before(t.rawFrom) {
+		t.rawFrom = covered
+	}
+
+	if r.conf.RollupDailyDays > 0 {
+		t.hourlyFrom = localDay(now.AddDate(0, 0, -r.conf.RollupHourlyDays)).AddDate(0, 0, 1)
+		// 聚合落后超过小时聚合的保留期时，按天聚合只读到原始记录起点所在的日期之前
+		if t.rawFrom.Before(t.hourlyFrom) {
+			t.hourlyFrom = localDay(t.rawFrom)
+		}
+	}
+	return t
+}
+
+func ceilHour(t time.Time) time.Time {
+	h := t.Truncate(time.Hour)
+	if h.Before(t) {
+		h = h.Add(time.Hour)
+	}
+	return h
+}
+
+// rollupSource 是一段时间范围对应的一个数据来源
+type rollupSource struct {
+	table      string // query_logs、rollup_hourly 或 rollup_daily
+	start, end time.Time
+}
+
+// sources 将查询范围按分界拆成至多三段，聚合表的起点对齐到桶的起点
+func (t rollupTiers) sources(q RollupQuery) []rollupSource {
+	var out []rollupSource
+	if t.rawFrom.IsZero() {
+		return []rollupSource{{"query_logs", q.Start, q.End}}
+	}
+	if q.Start.Before(t.hourlyFrom) {
+		out = append(out, rollupSource{"rollup_daily", localDay(q.Start), minTime(q.End, t.hourlyFrom)})
+	}
+	if start := maxTime(q.Start, t.hourlyFrom); start.Before(t.rawFrom) && start.Before(q.End) {
+		out = append(out, rollupSource{"rollup_hourly", start.Truncate(time.Hour), minTime(q.End, t.rawFrom)})
+	}
+	if start := maxTime(q.Start, t.rawFrom); start.Before(q.End) {
+		out = append(out, rollupSource{"query_logs", start, q.End})
+	}
+	return out
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// sourceSQL 返回这一段数据分组统计的子查询，列为 grp、count、elapsed_sum 及直方图各列。
+// 原始记录中维度的表达式为 rawExpr，聚合表中为 key 列（dim 为对应维度）。
+func (s rollupSource) sourceSQL(dim, rawExpr, rollupExpr, source string) (string, []interface{}) {
+	var (
+		sql  string
+		args []interface{}
+	)
+	if s.table == "query_logs" {
+		sql = "SELECT " + rawExpr + " AS grp, COUNT(*) AS count, SUM(elapsed) AS elapsed_sum, " + latencyHistogramSQL() +
+			" FROM query_logs WHERE " + timeWindowSQL
+		args = timeWindowArgs(s.start, s.end)
+	} else {
+		sql = "SELECT " + rollupExpr + " AS grp, SUM(count) AS count, SUM(elapsed_sum) AS elapsed_sum, " + sumHistogramSQL() +
+			" FROM " + s.table + " WHERE dim = ? AND bucket >= ? AND bucket < ?"
+		args = []interface{}{dim, s.start.UTC(), s.end.UTC()}
+	}
+	if source != "" {
+		sql += " AND source = ?"
+		args = append(args, source)
+	}
+	return sql + " GROUP BY grp", args
+}
+
+// Series 返回 q 范围内每小时（daily 为真时按 loc 的日期）的查询次数、平均延迟与延迟直方图。
+// 早于原始记录保留期的部分读聚合表，早于小时聚合保留期的部分只有按天的粒度。
+func (r *Rollups) Series(q RollupQuery, daily bool, loc *time.Location) ([]RollupPoint, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	points := make(map[time.Time]*RollupPoint)
+	for _, s := range r.tiers(time.Now()).sources(q) {
+		sql, args := s.sourceSQL(RollupTotal,
+			"strftime('%Y-%m-%d %H:00:00', time)", "strftime('%Y-%m-%d %H:%M:%S', bucket)", q.Source)
+		rows, err := r.db.Raw(sql, args...).Rows()
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var (
+				bucket string
+				p      = RollupPoint{Histogram: make([]int64, len(model.RollupLatencyBounds)+1)}
+			)
+			dest := []interface{}{&bucket, &p.Count, &p.elapsedSum}
+			for i := range p.Histogram {
+				dest = append(dest, &p.Histogram[i])
+			}
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			t, err := time.ParseInLocation(time.DateTime, bucket, time.UTC)
+			if err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("parse bucket %q: %w", bucket, err)
+			}
+			if daily {
+				t = t.In(loc)
+				t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+			}
+			mergePoint(points, t.In(loc), &p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]RollupPoint, 0, len(points))
+	for _, p := range points {
+		if p.Count > 0 {
+			p.AvgLatencyMs = float64(p.elapsedSum) / float64(p.Count) / 1000
+		}
+		out = append(out, *p)
+	}
+	slices.SortFunc(out, func(a, b RollupPoint) int { return a.Time.Compare(b.Time) })
+	return out, nil
+}
+
+func mergePoint(points map[time.Time]*RollupPoint, t time.Time, p *RollupPoint) {
+	key := t.UTC()
+	cur, ok := points[key]
+	if !ok {
+		p.Time = t
+		points[key] = p
+		return
+	}
+	cur.Count += p.Count
+	cur.elapsedSum += p.elapsedSum
+	for i, n := range p.Histogram {
+		cur.Histogram[i] += n
+	}
+}
+
+// Top 返回 q 范围内 dim 维度查询次数最多的 limit 项，跨越原始记录与聚合表时在 SQL 中合并计数
+func (r *Rollups) Top(q RollupQuery, dim string, limit int) ([]RollupTop, error) {
+	i := slices.IndexFunc(rollupDims, func(d rollupDim) bool { return d.name == dim })
+	if i < 0 || dim == RollupTotal {
+		return nil, fmt.Errorf("unknown dimension %q", dim)
+	}
+	rawExpr := rollupDims[i].expr
+
+	var (
+		parts []string
+		args  []interface{}
+	)
+	for _, s := range r.tiers(time.Now()).sources(q) {
+		sql, a := s.sourceSQL(dim, rawExpr, "key", q.Source)
+		parts = append(parts, sql)
+		args = append(args, a...)
+	}
+	out := make([]RollupTop, 0, limit)
+	if len(parts) == 0 {
+		return out, nil
+	}
+
+	sql := "SELECT grp, SUM(count) AS total, SUM(elapsed_sum) FROM (" + strings.Join(parts, " UNION ALL ") +
+		") GROUP BY grp ORDER BY total DESC LIMIT ?"
+	rows, err := r.db.Raw(sql, append(args, limit)...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			t          RollupTop
+			elapsedSum int64
+		)
+		if err := rows.Scan(&t.Key, &t.Count, &elapsedSum); err != nil {
+			return nil, err
+		}
+		if t.Count > 0 {
+			t.AvgLatencyMs = float64(elapsedSum) / float64(t.Count) / 1000
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
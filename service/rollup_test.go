@@ -0,0 +1,212 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"mosdns-log/config"
+	"mosdns-log/model"
+)
+
+func newRollupTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&model.QueryLog{}, &model.HourlyRollup{}, &model.DailyRollup{}, &model.RollupState{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetupTimeIndex(db); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// 新建的数据库尚未聚合任何小时，统计查询应直接读原始记录；聚合之后结果不变（不重复计数）
+func TestRollupQueriesBeforeAndAfterRollup(t *testing.T) {
+	db := newRollupTestDB(t)
+	now := time.Now()
+	cst := time.FixedZone("CST", 8*3600)
+	logs := []*model.QueryLog{
+		{Source: "main", QName: "a.example.com", ClientIP: "10.0.0.1", QType: 1, Elapsed: 800, Time: now.Add(-3 * time.Hour).In(cst)},
+		{Source: "main", QName: "a.example.com", ClientIP: "10.0.0.2", QType: 28, Elapsed: 3000, Time: now.Add(-3 * time.Hour).UTC()},
+		{Source: "main", QName: "b.example.com", ClientIP: "10.0.0.1", QType: 1, Elapsed: 20000, Time: now.Add(-5 * time.Minute).In(cst)},
+	}
+	if err := db.Create(logs).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRollups(db, &config.Config{DBRetentionDays: 7, RollupHourlyDays: 30, RollupDailyDays: 365})
+	q := RollupQuery{Start: now.Add(-24 * time.Hour), End: now.Add(time.Hour)}
+	check := func(stage string) {
+		t.Helper()
+		points, err := r.Series(q, false, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total int64
+		for _, p := range points {
+			total += p.Count
+		}
+		if total != 3 {
+			t.Errorf("%s: series total = %d, want 3 (%d points)", stage, total, len(points))
+		}
+
+		top, err := r.Top(q, RollupDomain, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(top) != 2 || top[0].Key != "a.example.com" || top[0].Count != 2 {
+			t.Errorf("%s: top domains = %+v, want a.example.com×2 first", stage, top)
+		}
+	}
+
+	check("before rollup")
+	if err := r.update(context.Background(), now.Add(-rollupDelay)); err != nil {
+		t.Fatal(err)
+	}
+	var rolled int64
+	db.Model(&model.HourlyRollup{}).Where("dim = ? AND source = ?", RollupTotal, "main").Select("SUM(count)").Scan(&rolled)
+	if rolled != 2 {
+		t.Fatalf("rolled up %d rows, want 2", rolled)
+	}
+	check("after rollup")
+}
+
+// source 为空的记录正常聚合；已聚合的小时和日期中后写入的记录在下一轮补计，且不重复计数
+func TestRollupLateRows(t *testing.T) {
+	db := newRollupTestDB(t)
+	r := NewRollups(db, &config.Config{DBRetentionDays: 7, RollupHourlyDays: 30, RollupDailyDays: 365})
+
+	now := time.Now()
+	old := now.AddDate(0, 0, -3).Truncate(time.Hour).Add(30 * time.Minute)
+	recent := now.Add(-3 * time.Hour).Truncate(time.Hour).Add(30 * time.Minute)
+	insert := func(logs ...*model.QueryLog) {
+		t.Helper()
+		if err := db.Create(logs).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	sum := func(table string, bucket time.Time, source string) int64 {
+		t.Helper()
+		var n int64
+		if err := db.Table(table).Where("bucket = ? AND source = ? AND dim = ?", bucket, source, RollupTotal).
+			Select("COALESCE(SUM(count), 0)").Scan(&n).Error; err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	update := func() {
+		t.Helper()
+		if err := r.update(context.Background(), now.Add(-rollupDelay)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insert(
+		&model.QueryLog{Source: "", QName: "a.example.com", Elapsed: 800, Time: old},
+		&model.QueryLog{Source: "main", QName: "a.example.com", Elapsed: 800, Time: old},
+		&model.QueryLog{Source: "", QName: "b.example.com", Elapsed: 800, Time: recent},
+	)
+	update()
+	oldHour, recentHour := old.UTC().Truncate(time.Hour), recent.UTC().Truncate(time.Hour)
+	oldDay := localDay(old).UTC()
+	if got := sum("rollup_hourly", oldHour, ""); got != 1 {
+		t.Fatalf("hourly count for empty source = %d, want 1", got)
+	}
+	if got := sum("rollup_daily", oldDay, ""); got != 1 {
+		t.Fatalf("daily count for empty source = %d, want 1", got)
+	}
+
+	// 回填到已聚合的小时与日期
+	insert(
+		&model.QueryLog{Source: "", QName: "c.example.com", Elapsed: 800, Time: old},
+		&model.QueryLog{Source: "", QName: "c.example.com", Elapsed: 800, Time: recent},
+	)
+	update()
+	update()
+	for _, tc := range []struct {
+		table  string
+		bucket time.Time
+		source string
+		want   int64
+	}{
+		{"rollup_hourly", oldHour, "", 2},
+		{"rollup_hourly", oldHour, "main", 1},
+		{"rollup_hourly", recentHour, "", 2},
+		{"rollup_daily", oldDay, "", 2},
+		{"rollup_daily", oldDay, "main", 1},
+	} {
+		if got := sum(tc.table, tc.bucket, tc.source); got != tc.want {
+			t.Errorf("%s %s source %q = %d, want %d", tc.table, tc.bucket.Format(time.RFC3339), tc.source, got, tc.want)
+		}
+	}
+
+	var domains int64
+	db.Model(&model.HourlyRollup{}).Where("bucket = ? AND dim = ? AND key = ?", oldHour, RollupDomain, "c.example.com").
+		Select("SUM(count)").Scan(&domains)
+	if domains != 1 {
+		t.Errorf("late domain count = %d, want 1", domains)
+	}
+}
+
+// 清理只删除已计入聚合表的记录
+func TestRetentionScopeSkipsUnrolledRows(t *testing.T) {
+	db := newRollupTestDB(t)
+	conf := &config.Config{DBRetentionDays: 7, RollupHourlyDays: 30, RollupDailyDays: 365}
+	c := NewCleaner(db, conf, nil)
+	t.Cleanup(c.cancel)
+
+	now := time.Now()
+	insert := func(at time.Time) {
+		t.Helper()
+		if err := db.Create(&model.QueryLog{Source: "main", QName: "example.com", Time: at}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func(scope *gorm.DB) int64 {
+		t.Helper()
+		var n int64
+		if err := scope.Count(&n).Error; err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	insert(now.Add(-3 * time.Hour))
+	insert(now.Add(-5 * time.Minute))
+	scope, err := c.retentionScope()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(scope); n != 0 {
+		t.Fatalf("before rollup: %d deletable rows, want 0", n)
+	}
+
+	c.rollup()
+	insert(now.Add(-3 * time.Hour)) // 已聚合的小时中后写入的记录
+	if scope, err = c.retentionScope(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(scope); n != 1 {
+		t.Errorf("after rollup: %d deletable rows, want 1", n)
+	}
+	// scope 可重复使用，条件不会累积
+	if n := count(scope.Where("q_name = ?", "example.com")); n != 1 {
+		t.Errorf("filtered scope: %d rows, want 1", n)
+	}
+	if n := count(scope); n != 1 {
+		t.Errorf("reused scope: %d rows, want 1", n)
+	}
+}
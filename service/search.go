@@ -0,0 +1,79 @@
+package service
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// minTrigramSearch 是能使用 trigram 索引的最短搜索词（按字节），更短的搜索词退回 LIKE 扫描
+const minTrigramSearch = 3
+
+// searchIndexDDL 创建 q_name、client_ip 的 FTS5 trigram 索引。索引以 query_logs 为外部内容表，
+// 不重复保存文本；由触发器随写入、保留期清理与内存模式淘汰同步，所有写入和删除路径都无需额外处理。
+var searchIndexDDL = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS query_logs_fts USING fts5(
+		q_name, client_ip, content='query_logs', content_rowid='id', tokenize='trigram')`,
+	`CREATE TRIGGER IF NOT EXISTS query_logs_fts_ai AFTER INSERT ON query_logs BEGIN
+		INSERT INTO query_logs_fts(rowid, q_name, client_ip) VALUES (new.id, new.q_name, new.client_ip);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS query_logs_fts_ad AFTER DELETE ON query_logs BEGIN
+		INSERT INTO query_logs_fts(query_logs_fts, rowid, q_name, client_ip) VALUES ('delete', old.id, old.q_name, old.client_ip);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS query_logs_fts_au AFTER UPDATE OF q_name, client_ip ON query_logs BEGIN
+		INSERT INTO query_logs_fts(query_logs_fts, rowid, q_name, client_ip) VALUES ('delete', old.id, old.q_name, old.client_ip);
+		INSERT INTO query_logs_fts(rowid, q_name, client_ip) VALUES (new.id, new.q_name, new.client_ip);
+	END`,
+}
+
+var searchIndexDrop = []string{
+	"DROP TRIGGER IF EXISTS query_logs_fts_ai",
+	"DROP TRIGGER IF EXISTS query_logs_fts_ad",
+	"DROP TRIGGER IF EXISTS query_logs_fts_au",
+	"DROP TABLE IF EXISTS query_logs_fts",
+}
+
+// SetupSearchIndex 按 search_index 创建或删除搜索索引。新建索引时为已有记录生成索引，
+// 关闭后再开启会重新生成，期间写入的记录不会遗漏。
+func SetupSearchIndex(db *gorm.DB, enabled bool) error {
+	stmts := searchIndexDrop
+	if enabled {
+		stmts = searchIndexDDL
+	}
+	var exists int64
+	if err := db.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'query_logs_fts'").Scan(&exists).Error; err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, s := range stmts {
+			if err := tx.Exec(s).Error; err != nil {
+				return err
+			}
+		}
+		if !enabled || exists > 0 {
+			return nil
+		}
+		start := time.Now()
+		if err := tx.Exec("INSERT INTO query_logs_fts(query_logs_fts) VALUES ('rebuild')").Error; err != nil {
+			return err
+		}
+		if d := time.Since(start); d > time.Second {
+			slog.Info("Search index built", "duration", d)
+		}
+		return nil
+	})
+}
+
+// LogSearchSQL 返回 /api/logs 中 search 参数（按子串匹配域名或客户端 IP）的查询条件。
+// 启用索引且搜索词不短于 3 字节时通过 trigram 索引查找，否则使用 LIKE 全表扫描。
+func LogSearchSQL(search string, indexed bool) (string, []interface{}) {
+	if !indexed || len(search) < minTrigramSearch {
+		return "q_name LIKE ? OR client_ip LIKE ?", []interface{}{"%" + search + "%", "%" + search + "%"}
+	}
+	// 整个搜索词作为一个短语，trigram 分词下即为不区分大小写的子串匹配
+	phrase := `"` + strings.ReplaceAll(search, `"`, `""`) + `"`
+	return "id IN (SELECT rowid FROM query_logs_fts WHERE query_logs_fts MATCH ?)", []interface{}{phrase}
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+	"mosdns-log/model"
+)
+
+const searchBenchRows = 200000
+
+// fillSearchBenchDB 写入 n 条域名与客户端各不相同的记录，时间按写入顺序递增
+func fillSearchBenchDB(b *testing.B, db *gorm.DB, n int) {
+	b.Helper()
+	start := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	logs := make([]*model.QueryLog, 0, maxInsertRows)
+	flush := func() {
+		if err := db.Transaction(func(tx *gorm.DB) error { return execRawInsert(tx, logs) }); err != nil {
+			b.Fatal(err)
+		}
+		logs = logs[:0]
+	}
+	for i := 0; i < n; i++ {
+		logs = append(logs, &model.QueryLog{
+			Source: "bench", UQID: i, ClientIP: fmt.Sprintf("10.%d.%d.%d", i>>16&255, i>>8&255, i&255), Protocol: "udp",
+			QName: fmt.Sprintf("host%d.site%d.example.com", i%20000, i%997), QType: 1, QClass: 1,
+			Elapsed: 1500, Time: start.Add(time.Duration(i) * time.Second),
+		})
+		if len(logs) == cap(logs) {
+			flush()
+		}
+	}
+	if len(logs) > 0 {
+		flush()
+	}
+}
+
+// BenchmarkLogSearch 比较 /api/logs 的 search 查询（计数加第一页）在 LIKE 全表扫描与 trigram 索引下的耗时，
+// 并在 -v 下输出两者的查询计划
+func BenchmarkLogSearch(b *testing.B) {
+	db := openBenchDB(b)
+	if err := SetupSearchIndex(db, true); err != nil {
+		b.Fatal(err)
+	}
+	fillSearchBenchDB(b, db, searchBenchRows)
+
+	for _, search := range []string{"host12345.", "site42.", "10.1.2.3"} {
+		for _, indexed := range []bool{false, true} {
+			name := "like"
+			if indexed {
+				name = "fts"
+			}
+			b.Run(name+"/"+search, func(b *testing.B) {
+				cond, args := LogSearchSQL(search, indexed)
+				query := func() *gorm.DB { return db.Model(&model.QueryLog{}).Where(cond, args...) }
+
+				var rows []struct {
+					Detail string
+				}
+				db.Raw("EXPLAIN QUERY PLAN SELECT * FROM query_logs WHERE "+cond+" ORDER BY time DESC LIMIT 50", args...).Scan(&rows)
+				details := make([]string, len(rows))
+				for i, r := range rows {
+					details[i] = r.Detail
+				}
+				b.Logf("plan: %s", strings.Join(details, "; "))
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					var total int64
+					var logs []model.QueryLog
+					if err := query().Count(&total).Error; err != nil {
+						b.Fatal(err)
+					}
+					if err := query().Order("time desc").Limit(50).Find(&logs).Error; err != nil {
+						b.Fatal(err)
+					}
+					if total == 0 {
+						b.Fatalf("no rows match %q", search)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkSearchIndexInsert 测量触发器维护搜索索引带来的写入开销
+func BenchmarkSearchIndexInsert(b *testing.B) {
+	for _, indexed := range []bool{false, true} {
+		b.Run(fmt.Sprintf("search_index=%v", indexed), func(b *testing.B) {
+			db := openBenchDB(b)
+			if err := SetupSearchIndex(db, indexed); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			fillSearchBenchDB(b, db, b.N)
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
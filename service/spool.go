@@ -0,0 +1,562 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	json "github.com/goccy/go-json"
+	"mosdns-log/model"
+)
+
+// spool 文件格式：
+//
+//	文件头：magic(4) | generation(8)
+//	记录：  length(4) | crc32c(4) | JSON(spoolRecord)
+//
+// generation 在每次清空文件时重新生成，与重放位置一起保存在 spool_states 中，
+// 用于识别文件已被清空后数据库里残留的旧偏移量。
+//
+// 同一批次因数据库之外的原因（如约束冲突）连续失败 spoolMaxAttempts 次后，
+// 写入 dead-letter 文件（spool 路径加 .dead 后缀，每行一个 JSON）并跳过，不再阻塞后续重放。
+const (
+	spoolMagic      = "MLSP"
+	spoolHeaderSize = 12
+	spoolRecordHead = 8
+	// spoolMaxRecord 单条记录的上限，超过视为文件损坏
+	spoolMaxRecord = 64 << 20
+
+	spoolMinBackoff  = time.Second
+	spoolMaxBackoff  = time.Minute
+	spoolMaxAttempts = 5
+)
+
+var (
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+	errSpoolFull = errors.New("spool is full")
+)
+
+// deadLetter 是 dead-letter 文件中的一行
+type deadLetter struct {
+	Time       time.Time             `json:"time"`
+	Error      string                `json:"error"`
+	Logs       []*model.QueryLog     `json:"logs"`
+	Checkpoint *model.TailCheckpoint `json:"checkpoint,omitempty"`
+}
+
+// spoolRecord 是写入 spool 的一个批次
+type spoolRecord struct {
+	Logs       []*model.QueryLog     `json:"logs"`
+	Checkpoint *model.TailCheckpoint `json:"checkpoint,omitempty"`
+}
+
+// spool 是数据库写入失败时的磁盘缓冲区：只追加写入，由 spoolWorker 按顺序重放
+type spool struct {
+	path    string
+	maxSize int64
+
+	mu          sync.Mutex
+	f           *os.File
+	generation  uint64
+	size        int64                            // 文件长度（下一条记录的写入位置）
+	readOff     int64                            // 下一条待重放记录的位置
+	checkpoints map[string]*model.TailCheckpoint // 各日志文件在 spool 中最新的断点
+	// superseded 记录直接写入数据库的批次已更新过断点的日志文件，
+	// 值为当时的文件长度，在此之前的记录重放时不再写回各自（更旧的）断点
+	superseded map[string]int64
+	deadOff    int64 // 已写入 dead-letter 文件、尚未跳过的记录位置，避免重试时重复写入
+	notify     chan struct{}
+
+	// writeMu 串行化直接写入与重放，使断点的写入顺序与 superseded 一致
+	writeMu sync.Mutex
+}
+
+// openSpool 打开（必要时创建）spool 文件，从 state 记录的位置开始校验剩余记录。
+// 文件末尾不完整或校验失败的记录会被截掉。
+func openSpool(path string, maxSize int64, state *model.SpoolState) (*spool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sp := &spool{
+		path:        path,
+		maxSize:     maxSize,
+		f:           f,
+		checkpoints: make(map[string]*model.TailCheckpoint),
+		superseded:  make(map[string]int64),
+		notify:      make(chan struct{}, 1),
+	}
+
+	header := make([]byte, spoolHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil || string(header[:4]) != spoolMagic {
+		// 新文件或文件头损坏
+		if err := sp.reset(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return sp, nil
+	}
+	sp.generation = spoolGeneration(header[4:])
+
+	sp.readOff = spoolHeaderSize
+	if state != nil && state.Generation == sp.generation && state.Offset > spoolHeaderSize {
+		sp.readOff = state.Offset
+	}
+
+	if err := sp.scan(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return sp, nil
+}
+
+// scan 从 readOff 开始校验记录，重建断点索引，并截掉末尾无效的数据
+func (sp *spool) scan() error {
+	fi, err := sp.f.Stat()
+	if err != nil {
+		return err
+	}
+	end := fi.Size()
+	if sp.readOff > end {
+		// 偏移量超出文件长度，说明文件已被清空
+		sp.readOff = spoolHeaderSize
+	}
+
+	off := sp.readOff
+	for off < end {
+		rec, next, err := sp.readAt(off)
+		if err != nil {
+			slog.Error("Spool is corrupted, discarding the remaining data", "path", sp.path, "offset", off, "discarded_bytes", end-off, "error", err)
+			if err := sp.f.Truncate(off); err != nil {
+				return err
+			}
+			break
+		}
+		sp.trackCheckpoint(rec)
+		off = next
+	}
+	sp.size = off
+	return nil
+}
+
+// reset 清空文件并写入新的文件头，调用方需持有 sp.mu（或在初始化时调用）
+func (sp *spool) reset() error {
+	if err := sp.f.Truncate(0); err != nil {
+		return err
+	}
+	var gen [8]byte
+	if _, err := rand.Read(gen[:]); err != nil {
+		return err
+	}
+	header := append([]byte(spoolMagic), gen[:]...)
+	if _, err := sp.f.Write(header); err != nil {
+		return err
+	}
+	if err := sp.f.Sync(); err != nil {
+		return err
+	}
+	sp.generation = spoolGeneration(gen[:])
+	sp.size = spoolHeaderSize
+	sp.readOff = spoolHeaderSize
+	sp.deadOff = 0
+	clear(sp.checkpoints)
+	clear(sp.superseded)
+	return nil
+}
+
+// spoolGeneration 读取文件头中的 generation。database/sql 不接受最高位为 1 的 uint64，
+// 因此去掉最高位后再与 spool_states 中的值比较与保存
+func spoolGeneration(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b) &^ (1 << 63)
+}
+
+func (sp *spool) readAt(off int64) (*spoolRecord, int64, error) {
+	head := make([]byte, spoolRecordHead)
+	if _, err := sp.f.ReadAt(head, off); err != nil {
+		return nil, 0, err
+	}
+	n := binary.BigEndian.Uint32(head[:4])
+	if n == 0 || n > spoolMaxRecord {
+		return nil, 0, fmt.Errorf("invalid record length %d", n)
+	}
+	payload := make([]byte, n)
+	if _, err := sp.f.ReadAt(payload, off+spoolRecordHead); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.Checksum(payload, crc32c) != binary.BigEndian.Uint32(head[4:]) {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+
+	var rec spoolRecord
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return nil, 0, err
+	}
+	// IPKey 不参与序列化，重放前重新计算；BaseDomain 随记录保存，缺失时补全
+	for _, l := range rec.Logs {
+		if l.BaseDomain == "" {
+			l.BaseDomain = BaseDomain(l.QName)
+		}
+		for i, a := range l.Answers {
+			l.Answers[i] = newAnswer(a.Type, a.TTL, a.Data)
+		}
+	}
+	return &rec, off + spoolRecordHead + int64(n), nil
+}
+
+func (sp *spool) trackCheckpoint(rec *spoolRecord) {
+	if rec.Checkpoint != nil {
+		cp := *rec.Checkpoint
+		sp.checkpoints[cp.Path] = &cp
+	}
+}
+
+// append 追加一条记录并 fsync，返回后数据即可视为已持久化
+func (sp *spool) append(rec *spoolRecord) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sp.maxSize > 0 && sp.size+int64(len(payload))+spoolRecordHead > sp.maxSize {
+		return errSpoolFull
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(spoolRecordHead + len(payload))
+	var head [spoolRecordHead]byte
+	binary.BigEndian.PutUint32(head[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(head[4:], crc32.Checksum(payload, crc32c))
+	buf.Write(head[:])
+	buf.Write(payload)
+
+	if _, err := sp.f.Write(buf.Bytes()); err != nil {
+		// 写入了部分数据时回退到原长度，避免留下半条记录
+		sp.f.Truncate(sp.size)
+		return err
+	}
+	if err := sp.f.Sync(); err != nil {
+		return err
+	}
+	sp.size += int64(buf.Len())
+	sp.trackCheckpoint(rec)
+
+	select {
+	case sp.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pending 返回是否还有未重放的记录
+func (sp *spool) pending() bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.readOff < sp.size
+}
+
+// peek 读取下一条待重放的记录及其起止位置，没有时返回 nil
+func (sp *spool) peek() (rec *spoolRecord, off, next int64, err error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.readOff >= sp.size {
+		return nil, 0, 0, nil
+	}
+	off = sp.readOff
+	rec, next, err = sp.readAt(off)
+	return rec, off, next, err
+}
+
+// state 返回重放到 off 时应保存到数据库的 spool 重放位置
+func (sp *spool) state(off int64) *model.SpoolState {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return &model.SpoolState{Path: sp.path, Generation: sp.generation, Offset: off, UpdatedAt: time.Now()}
+}
+
+// supersede 在 cp 所属日志文件的更新断点已直接写入数据库后调用，
+// 使 spool 中该文件已有的记录重放时不再把断点写回旧位置
+func (sp *spool) supersede(cp *model.TailCheckpoint) {
+	if cp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if _, ok := sp.checkpoints[cp.Path]; !ok {
+		return
+	}
+	delete(sp.checkpoints, cp.Path)
+	sp.superseded[cp.Path] = sp.size
+}
+
+// replayCheckpoint 返回结束于 next 的记录重放时应写入的断点，已被直接写入的批次取代时返回 nil
+func (sp *spool) replayCheckpoint(rec *spoolRecord, next int64) *model.TailCheckpoint {
+	if rec.Checkpoint == nil {
+		return nil
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if end, ok := sp.superseded[rec.Checkpoint.Path]; ok && next <= end {
+		return nil
+	}
+	return rec.Checkpoint
+}
+
+// deadLetter 将 off 处反复写入失败的记录追加到 dead-letter 文件
+func (sp *spool) deadLetter(off int64, rec *spoolRecord, cause error) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.deadOff == off {
+		return nil
+	}
+
+	line, err := json.Marshal(deadLetter{Time: time.Now(), Error: cause.Error(), Logs: rec.Logs, Checkpoint: rec.Checkpoint})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(sp.path+".dead", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	sp.deadOff = off
+	return nil
+}
+
+// advance 标记 off 之前的记录已写入数据库，全部重放完成后清空文件
+func (sp *spool) advance(off int64) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.readOff = off
+	if sp.readOff < sp.size {
+		return
+	}
+	if err := sp.reset(); err != nil {
+		slog.Error("Failed to reset spool", "path", sp.path, "error", err)
+	}
+}
+
+// checkpoint 返回 spool 中尚未重放的、path 的最新断点
+func (sp *spool) checkpoint(path string) *model.TailCheckpoint {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if cp, ok := sp.checkpoints[path]; ok {
+		c := *cp
+		return &c
+	}
+	return nil
+}
+
+func (sp *spool) close() error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.f.Close()
+}
+
+// ============================================================================
+// Collector 中与 spool 相关的逻辑
+// ============================================================================
+
+// initSpool 打开 spool；非持久化模式下数据库每次启动都会重建，旧数据不再重放
+func (c *Collector) initSpool(path string, maxSize int64) {
+	var state *model.SpoolState
+	if c.persist {
+		var st model.SpoolState
+		if err := c.db.Where("path = ?", path).Limit(1).Find(&st).Error; err == nil && st.Path != "" {
+			state = &st
+		}
+	} else {
+		os.Remove(path)
+	}
+
+	sp, err := openSpool(path, maxSize, state)
+	if err != nil {
+		slog.Error("Spool disabled", "path", path, "error", err)
+		return
+	}
+	c.spool = sp
+	if !sp.pending() {
+		return
+	}
+	slog.Warn("Spool has unreplayed batches", "path", path, "bytes", sp.size-sp.readOff)
+
+	// 上次运行时直接写入数据库的批次可能已把断点推进到 spool 中的断点之后
+	for p, cp := range sp.checkpoints {
+		var saved model.TailCheckpoint
+		if err := c.db.Where("path = ?", p).Limit(1).Find(&saved).Error; err == nil && saved.UpdatedAt.After(cp.UpdatedAt) {
+			sp.supersede(&saved)
+		}
+	}
+}
+
+// storeBatch 写入一批数据，写入数据库失败时追加到 spool，由 spoolWorker 稍后重放。
+// spool 中有待重放的数据时（数据库刚恢复，或某个批次反复失败正在退避）新批次同样先尝试写入数据库，
+// 成功后 spool 中同一文件的旧断点作废，重放时不会把断点写回旧位置。
+func (c *Collector) storeBatch(b *ingestBatch) error {
+	if c.spool == nil {
+		return c.writeBatch(b.logs, b.checkpoint, nil)
+	}
+
+	c.spool.writeMu.Lock()
+	err := c.writeBatch(b.logs, b.checkpoint, nil)
+	if err == nil {
+		c.spool.supersede(b.checkpoint)
+	}
+	c.spool.writeMu.Unlock()
+	if err == nil {
+		return nil
+	}
+
+	if err := c.spool.append(&spoolRecord{Logs: b.logs, Checkpoint: b.checkpoint}); err != nil {
+		slog.Error("[Spool] Failed to spool batch, batch dropped", "rows", len(b.logs), "error", err)
+		return err
+	}
+	c.metrics.rowsSpooled.Add(int64(len(b.logs)))
+	return nil
+}
+
+// replay 将结束于 next 的记录写回数据库
+func (c *Collector) replay(rec *spoolRecord, next int64) error {
+	c.spool.writeMu.Lock()
+	defer c.spool.writeMu.Unlock()
+	return c.writeBatch(rec.Logs, c.spool.replayCheckpoint(rec, next), c.spool.state(next))
+}
+
+// skipDeadLetter 将反复失败的记录写入 dead-letter 文件，并在数据库中越过它（断点照常推进）
+func (c *Collector) skipDeadLetter(rec *spoolRecord, off, next int64, cause error) error {
+	if err := c.spool.deadLetter(off, rec, cause); err != nil {
+		return err
+	}
+	c.spool.writeMu.Lock()
+	defer c.spool.writeMu.Unlock()
+	return c.writeBatch(nil, c.spool.replayCheckpoint(rec, next), c.spool.state(next))
+}
+
+// spoolWorker 按顺序将 spool 中的批次写回数据库，失败时指数退避。
+// 数据库暂时不可用时一直重试；同一批次因其他原因连续失败 spoolMaxAttempts 次后移入 dead-letter 文件
+func (c *Collector) spoolWorker() {
+	defer c.wg.Done()
+
+	backoff := spoolMinBackoff
+	attempts := 0 // 当前记录因非临时错误失败的次数
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.spool.notify:
+			// 新追加的记录等待本轮退避结束后再重放
+			continue
+		case <-timer.C:
+		}
+
+		replayed, dead := c.replaySpool(&attempts)
+		if c.spool.pending() {
+			slog.Warn("[Spool] Replay failed, retrying", "replayed", replayed, "dead_lettered", dead, "retry_in", backoff)
+			timer.Reset(backoff)
+			backoff = min(backoff*2, spoolMaxBackoff)
+			continue
+		}
+		if replayed+dead > 0 {
+			slog.Info("[Spool] Replay finished", "batches", replayed, "dead_lettered", dead)
+		}
+		backoff = spoolMinBackoff
+		// 空闲时等待新数据被追加
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.spool.notify:
+			timer.Reset(backoff)
+		}
+	}
+}
+
+// replaySpool 按顺序重放 spool 中的记录，遇到无法写入的记录时停止。
+// attempts 为当前记录因非临时错误失败的次数，达到 spoolMaxAttempts 时把记录移入 dead-letter 文件
+func (c *Collector) replaySpool(attempts *int) (replayed, dead int) {
+	for {
+		rec, off, next, err := c.spool.peek()
+		if err != nil {
+			slog.Error("[Spool] Failed to read spool", "error", err)
+			return
+		}
+		if rec == nil {
+			return
+		}
+		if err := c.replay(rec, next); err != nil {
+			if transientError(err) {
+				return
+			}
+			if *attempts++; *attempts < spoolMaxAttempts {
+				return
+			}
+			if err := c.skipDeadLetter(rec, off, next, err); err != nil {
+				slog.Error("[Spool] Failed to dead-letter batch", "offset", off, "error", err)
+				return
+			}
+			slog.Error("[Spool] Batch moved to dead-letter file", "path", c.spool.path+".dead",
+				"rows", len(rec.Logs), "attempts", *attempts, "error", err)
+			c.metrics.rowsDead.Add(int64(len(rec.Logs)))
+			dead++
+		} else {
+			replayed++
+		}
+		*attempts = 0
+		c.spool.advance(next)
+	}
+}
+
+// SQLite 的主结果码，见 https://www.sqlite.org/rescode.html
+const (
+	sqliteBusy     = 5
+	sqliteLocked   = 6
+	sqliteNoMem    = 7
+	sqliteReadOnly = 8
+	sqliteIOErr    = 10
+	sqliteFull     = 13
+	sqliteCantOpen = 14
+	sqliteProtocol = 15
+)
+
+// transientError 判断写入错误是否与批次内容无关、稍后重试可能成功：数据库忙或被锁、I/O 错误、
+// 磁盘已满、超时等。约束冲突、数据过大等错误无论重试多少次都会失败
+func transientError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+	// 驱动的错误类型实现了 Code()，扩展结果码的低 8 位为主结果码
+	var se interface{ Code() int }
+	if !errors.As(err, &se) {
+		return false
+	}
+	switch se.Code() & 0xff {
+	case sqliteBusy, sqliteLocked, sqliteNoMem, sqliteReadOnly, sqliteIOErr, sqliteFull, sqliteCantOpen, sqliteProtocol:
+		return true
+	}
+	return false
+}
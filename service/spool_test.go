@@ -0,0 +1,136 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"mosdns-log/config"
+	"mosdns-log/model"
+)
+
+func newSpoolTestCollector(t *testing.T) (*Collector, *gorm.DB) {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&model.QueryLog{}, &model.QueryAnswer{}, &model.TailCheckpoint{}, &model.SpoolState{}); err != nil {
+		t.Fatal(err)
+	}
+	// 模拟与数据库状态无关、重试也不会成功的写入错误
+	if err := db.Exec(`CREATE TRIGGER reject_poison BEFORE INSERT ON query_logs WHEN NEW.q_name = 'poison'
+		BEGIN SELECT RAISE(ABORT, 'poison row'); END`).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	c := NewCollector(db, &config.Config{DBPersist: true, SpoolPath: filepath.Join(dir, "test.spool")}, nil)
+	if c.spool == nil {
+		t.Fatal("spool not opened")
+	}
+	t.Cleanup(func() { c.spool.close() })
+	return c, db
+}
+
+// 反复失败的批次移入 dead-letter 文件，不阻塞后续批次；重放期间直接写入的断点不会被旧断点覆盖
+func TestSpoolDeadLetter(t *testing.T) {
+	c, db := newSpoolTestCollector(t)
+	now := time.Now()
+	cp := func(off int64, at time.Time) *model.TailCheckpoint {
+		return &model.TailCheckpoint{Path: "mosdns.log", Inode: 1, Offset: off, UpdatedAt: at}
+	}
+
+	poison := &spoolRecord{Logs: []*model.QueryLog{{QName: "poison", Time: now}}, Checkpoint: cp(100, now)}
+	good := &spoolRecord{Logs: []*model.QueryLog{{QName: "spooled.example.com", Time: now}}, Checkpoint: cp(200, now)}
+	for _, rec := range []*spoolRecord{poison, good} {
+		if err := c.spool.append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// spool 中有待重放的数据时，新批次仍直接写入数据库
+	live := &ingestBatch{logs: []*model.QueryLog{{QName: "live.example.com", Time: now}}, checkpoint: cp(300, now.Add(time.Second))}
+	if err := c.storeBatch(live); err != nil {
+		t.Fatal(err)
+	}
+	if c.metrics.rowsSpooled.Load() != 0 {
+		t.Fatalf("live batch was spooled")
+	}
+
+	attempts := 0
+	for i := 1; i < spoolMaxAttempts; i++ {
+		if replayed, dead := c.replaySpool(&attempts); replayed != 0 || dead != 0 {
+			t.Fatalf("attempt %d: replayed %d, dead %d before reaching the attempt limit", i, replayed, dead)
+		}
+	}
+	if replayed, dead := c.replaySpool(&attempts); replayed != 1 || dead != 1 {
+		t.Fatalf("replayed %d, dead %d; want 1, 1", replayed, dead)
+	}
+	if c.spool.pending() {
+		t.Fatal("spool still pending")
+	}
+
+	var names []string
+	db.Model(&model.QueryLog{}).Order("id").Pluck("q_name", &names)
+	if fmt.Sprint(names) != "[live.example.com spooled.example.com]" {
+		t.Errorf("rows = %v", names)
+	}
+	var saved model.TailCheckpoint
+	db.Where("path = ?", "mosdns.log").First(&saved)
+	if saved.Offset != 300 {
+		t.Errorf("checkpoint offset = %d, want 300 (from the live batch)", saved.Offset)
+	}
+	var state model.SpoolState
+	if err := db.Where("path = ?", c.spool.path).First(&state).Error; err != nil {
+		t.Errorf("spool state not saved: %v", err)
+	}
+
+	f, err := os.Open(c.spool.path + ".dead")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []string
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		lines = append(lines, sc.Text())
+	}
+	if len(lines) != 1 {
+		t.Fatalf("dead-letter file has %d lines, want 1", len(lines))
+	}
+}
+
+type codeError int
+
+func (e codeError) Error() string { return fmt.Sprintf("sqlite error %d", int(e)) }
+func (e codeError) Code() int     { return int(e) }
+
+func TestTransientError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{codeError(sqliteBusy), true},
+		{codeError(sqliteBusy | 1<<8), true}, // SQLITE_BUSY_RECOVERY
+		{fmt.Errorf("insert: %w", codeError(sqliteIOErr|3<<8)), true},
+		{codeError(19), false}, // SQLITE_CONSTRAINT
+		{errors.New("unknown"), false},
+	}
+	for _, tc := range cases {
+		if got := transientError(tc.err); got != tc.want {
+			t.Errorf("transientError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"mosdns-log/config"
+)
+
+const (
+	// maxProbeLines 二分查找时每次最多向后查看的行数，超过仍找不到带时间的记录则视为没有
+	maxProbeLines = 4096
+	// maxLineBefore 为断点读取起始位置之前的一行时最多回读的字节数
+	maxLineBefore = 64 << 10
+)
+
+// startTime 是 start_from 为时间戳时的读取模式
+const startTime = "time"
+
+// StartPosition 是首次打开日志文件时的读取位置
+type StartPosition struct {
+	Mode string    // config.StartBeginning、StartEnd、StartCheckpoint，时间戳为 "time"
+	Time time.Time // 时间戳模式下的起始时间
+}
+
+// ParseStartFrom 解析 start_from：beginning、end、checkpoint（默认），
+// 或 RFC 3339 / "2006-01-02 15:04:05" 格式的时间戳，后者按 tz 解释（为空时使用本地时区）
+func ParseStartFrom(value, tz string) (StartPosition, error) {
+	switch v := strings.ToLower(strings.TrimSpace(value)); v {
+	case "", config.StartCheckpoint:
+		return StartPosition{Mode: config.StartCheckpoint}, nil
+	case config.StartBeginning, config.StartEnd:
+		return StartPosition{Mode: v}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return StartPosition{Mode: startTime, Time: t}, nil
+	}
+	loc := time.Local
+	if tz != "" {
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			return StartPosition{}, fmt.Errorf("invalid timezone %q: %w", tz, err)
+		}
+		loc = l
+	}
+	t, err := time.ParseInLocation(time.DateTime, value, loc)
+	if err != nil {
+		return StartPosition{}, fmt.Errorf("invalid start_from %q: want beginning, end, checkpoint or a timestamp", value)
+	}
+	return StartPosition{Mode: startTime, Time: t}, nil
+}
+
+// seekTime 二分查找文件中第一条时间不早于 target 的记录所在的行首。
+// 时间由解析器从查询记录中取得，无法解析的行不参与比较；假定记录大致按时间顺序写入。
+func seekTime(file *os.File, size int64, parser Parser, target time.Time) int64 {
+	lo, hi := int64(0), size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, end, t, ok := probeTime(file, size, mid, hi, parser)
+		switch {
+		case !ok:
+			// [mid, hi) 中没有带时间的记录
+			hi = mid
+		case !t.Before(target):
+			hi = start
+		default:
+			lo = end
+		}
+	}
+	return lo
+}
+
+// probeTime 从 off 之后的第一个行首开始，找到第一条能解析出时间的记录，
+// 返回其所在行的起止位置。记录须在 hi 之前开始。
+func probeTime(file *os.File, size, off, hi int64, parser Parser) (start, end int64, t time.Time, ok bool) {
+	start = off
+	if off > 0 {
+		// 从 off-1 开始跳过半行：off 恰好是行首时只跳过上一行的换行符
+		start = off - 1
+	}
+	r := bufio.NewReader(io.NewSectionReader(file, start, size-start))
+	if off > 0 {
+		skipped, err := r.ReadString('\n')
+		if err != nil {
+			return 0, 0, time.Time{}, false
+		}
+		start += int64(len(skipped))
+	}
+
+	for range maxProbeLines {
+		if start >= hi {
+			break
+		}
+		line, err := r.ReadString('\n')
+		if line == "" {
+			break
+		}
+		end = start + int64(len(line))
+		if ql, perr := parser.Parse(strings.TrimRight(line, "\r\n")); perr == nil && ql != nil && !ql.Time.IsZero() {
+			return start, end, ql.Time, true
+		}
+		if err != nil {
+			break
+		}
+		start = end
+	}
+	return 0, 0, time.Time{}, false
+}
+
+// lastLineStart 返回文件末尾不完整的一行的行首，文件以换行符结尾时返回 size
+func lastLineStart(file *os.File, size int64) int64 {
+	if size == 0 {
+		return 0
+	}
+	n := min(size, maxLineBefore)
+	buf := make([]byte, n)
+	if _, err := file.ReadAt(buf, size-n); err != nil {
+		return size
+	}
+	if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+		return size - n + int64(i) + 1
+	}
+	if n == size {
+		return 0
+	}
+	return size
+}
+
+// lineBefore 返回 off 之前的一行（含换行符），用于在文件中间开始读取时生成可校验的断点。
+// 该行超过 maxLineBefore 时只返回末尾部分，同样可以用于校验。
+func lineBefore(file *os.File, off int64) string {
+	if off <= 0 {
+		return ""
+	}
+	n := min(off, maxLineBefore)
+	buf := make([]byte, n)
+	if _, err := file.ReadAt(buf, off-n); err != nil {
+		return ""
+	}
+	if i := bytes.LastIndexByte(buf[:n-1], '\n'); i >= 0 {
+		buf = buf[i+1:]
+	}
+	return string(buf)
+}
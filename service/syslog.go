@@ -0,0 +1,358 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mosdns-log/config"
+	"mosdns-log/model"
+)
+
+const (
+	syslogMaxMessage = 64 * 1024
+	// syslogMaxHosts 有状态解析器按发送主机分别保存，超过该数量时全部重建
+	syslogMaxHosts = 256
+	rfc3164Layout  = "Jan _2 15:04:05"
+)
+
+var errSyslogFrameTooLong = errors.New("syslog frame too long")
+
+// syslogReceiver 接收通过 syslog（RFC 5424 / RFC 3164）发送的 mosdns 日志
+type syslogReceiver struct {
+	conf   config.SyslogConfig
+	opts   ParserOptions
+	parser Parser         // 无状态的解析器由所有发送主机共用
+	loc    *time.Location // RFC 3164 头部时间戳的时区
+	rows   chan *model.QueryLog
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+
+	// hostParsers 有状态的解析器（如 dnsmasq）每个发送主机一个实例，
+	// 避免一台主机的查询与另一台主机的应答配对
+	parsersMu   sync.Mutex
+	hostParsers map[string]Parser
+}
+
+func newSyslogReceiver(conf config.SyslogConfig) (*syslogReceiver, error) {
+	if conf.Network == "" {
+		conf.Network = "both"
+	}
+	tp, err := NewTimeParser(conf.TimeLayouts, conf.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	opts := ParserOptions{TimeLayouts: conf.TimeLayouts, Timezone: conf.Timezone}
+	parser, err := NewParser(conf.Format, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogReceiver{
+		conf:        conf,
+		opts:        opts,
+		parser:      parser,
+		loc:         tp.Location(),
+		rows:        make(chan *model.QueryLog, rowQueue),
+		conns:       make(map[net.Conn]struct{}),
+		hostParsers: make(map[string]Parser),
+	}, nil
+}
+
+// parserFor 返回解析 host 发来的消息所用的解析器
+func (r *syslogReceiver) parserFor(host string) Parser {
+	if _, ok := r.parser.(sequentialParser); !ok {
+		return r.parser
+	}
+
+	r.parsersMu.Lock()
+	defer r.parsersMu.Unlock()
+	if p, ok := r.hostParsers[host]; ok {
+		return p
+	}
+	if len(r.hostParsers) >= syslogMaxHosts {
+		clear(r.hostParsers)
+	}
+	// 格式与选项已在 newSyslogReceiver 中校验过
+	p, err := NewParser(r.conf.Format, r.opts)
+	if err != nil {
+		return r.parser
+	}
+	r.hostParsers[host] = p
+	return p
+}
+
+// startSyslog 启动 UDP / TCP 监听以及负责攒批的 syslogWorker
+func (c *Collector) startSyslog() {
+	r := c.syslog
+	network := r.conf.Network
+
+	if network == "udp" || network == "both" {
+		pc, err := net.ListenPacket("udp", r.conf.Listen)
+		if err != nil {
+			slog.Error("Failed to listen syslog", "network", "udp", "addr", r.conf.Listen, "error", err)
+		} else {
+			c.wg.Add(1)
+			go c.syslogUDP(pc)
+		}
+	}
+
+	if network == "tcp" || network == "both" {
+		ln, err := net.Listen("tcp", r.conf.Listen)
+		if err != nil {
+			slog.Error("Failed to listen syslog", "network", "tcp", "addr", r.conf.Listen, "error", err)
+		} else {
+			c.wg.Add(1)
+			go c.syslogTCP(ln)
+		}
+	}
+
+	c.producers.Add(1)
+	go c.rowWorker(r.rows)
+	slog.Info("Syslog receiver started", "addr", r.conf.Listen, "network", network)
+}
+
+func (c *Collector) syslogUDP(pc net.PacketConn) {
+	defer c.wg.Done()
+	go func() {
+		<-c.ctx.Done()
+		pc.Close()
+	}()
+
+	buf := make([]byte, syslogMaxMessage)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+			slog.Error("Syslog UDP read failed", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		c.handleSyslog(string(buf[:n]), addr)
+	}
+}
+
+func (c *Collector) syslogTCP(ln net.Listener) {
+	defer c.wg.Done()
+	r := c.syslog
+	go func() {
+		<-c.ctx.Done()
+		ln.Close()
+		r.mu.Lock()
+		for conn := range r.conns {
+			conn.Close()
+		}
+		r.mu.Unlock()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+			slog.Error("Syslog TCP accept failed", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		r.mu.Lock()
+		r.conns[conn] = struct{}{}
+		r.mu.Unlock()
+
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			defer func() {
+				r.mu.Lock()
+				delete(r.conns, conn)
+				r.mu.Unlock()
+				conn.Close()
+			}()
+			c.syslogConn(conn)
+		}()
+	}
+}
+
+// syslogConn 读取一个 TCP 连接上的消息，支持 RFC 6587 的 octet-counting 与换行分帧
+func (c *Collector) syslogConn(conn net.Conn) {
+	reader := bufio.NewReaderSize(conn, syslogMaxMessage)
+	for {
+		msg, err := readSyslogFrame(reader)
+		if msg != "" {
+			c.handleSyslog(msg, conn.RemoteAddr())
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, errSyslogFrameTooLong):
+				slog.Warn("Syslog frame exceeds size limit, closing connection", "remote", conn.RemoteAddr(), "limit", syslogMaxMessage)
+			case !errors.Is(err, io.EOF) && c.ctx.Err() == nil:
+				slog.Debug("Syslog TCP connection closed", "remote", conn.RemoteAddr(), "error", err)
+			}
+			return
+		}
+	}
+}
+
+// readSyslogFrame 读取一条消息。r 的缓冲区大小即单条消息的上限，
+// 超过上限仍没有分隔符时返回 errSyslogFrameTooLong，调用方据此断开连接
+func readSyslogFrame(r *bufio.Reader) (string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+
+	// octet-counting: "MSG-LEN SP SYSLOG-MSG"
+	if b[0] >= '1' && b[0] <= '9' {
+		lenStr, err := r.ReadSlice(' ')
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				err = errSyslogFrameTooLong
+			}
+			return "", err
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(string(lenStr), " "))
+		if err != nil || n > syslogMaxMessage {
+			return "", errors.New("invalid syslog frame length")
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		return string(buf), nil
+	}
+
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", errSyslogFrameTooLong
+	}
+	return string(line), err
+}
+
+// handleSyslog 提取 _query_summary 消息并按发送主机标记来源
+func (c *Collector) handleSyslog(raw string, addr net.Addr) {
+	host, ts, body := parseSyslog(strings.TrimRight(raw, "\r\n\x00"), c.syslog.loc)
+
+	if host == "" || host == "-" {
+		host = addr.String()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+
+	// 消息正文不带时间戳时使用 syslog 头部时间，都没有则使用接收时间
+	ql := c.parseTracked(c.syslog.parserFor(host), lineOrigin{source: host, path: "syslog"}, body, ts)
+	if ql == nil {
+		return
+	}
+
+	select {
+	case c.syslog.rows <- ql:
+	case <-c.ctx.Done():
+	}
+}
+
+// parseSyslog 解析 RFC 5424 或 RFC 3164 格式的消息，返回主机名、时间戳与消息正文。
+// RFC 3164 的时间戳不带时区，按 loc 解释。无法识别的头部按原样作为正文返回。
+func parseSyslog(msg string, loc *time.Location) (host string, ts time.Time, body string) {
+	// PRI: "<N>"
+	if !strings.HasPrefix(msg, "<") {
+		return "", time.Time{}, msg
+	}
+	end := strings.IndexByte(msg, '>')
+	if end < 2 || end > 4 {
+		return "", time.Time{}, msg
+	}
+	rest := msg[end+1:]
+
+	if strings.HasPrefix(rest, "1 ") {
+		return parseRFC5424(rest[2:])
+	}
+	return parseRFC3164(rest, loc)
+}
+
+// parseRFC5424: TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA [SP MSG]
+func parseRFC5424(s string) (host string, ts time.Time, body string) {
+	fields := strings.SplitN(s, " ", 6)
+	if len(fields) < 6 {
+		return "", time.Time{}, s
+	}
+	if fields[0] != "-" {
+		ts, _ = time.Parse(time.RFC3339Nano, fields[0])
+	}
+	host = fields[1]
+
+	rest := fields[5]
+	if strings.HasPrefix(rest, "-") {
+		rest = rest[1:]
+	} else {
+		// 跳过一个或多个 SD-ELEMENT，注意 PARAM-VALUE 中转义的 "]"
+		for strings.HasPrefix(rest, "[") {
+			i := 1
+			for i < len(rest) && rest[i] != ']' {
+				if rest[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(rest) {
+				rest = ""
+				break
+			}
+			rest = rest[i+1:]
+		}
+	}
+	body = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\xEF\xBB\xBF")
+	return host, ts, body
+}
+
+// parseRFC3164Time 解析行首 "Mmm dd hh:mm:ss" 格式的时间戳，按 loc 时区解释。
+// 该格式不带年份，取当前年份；跨年时避免出现未来时间。
+func parseRFC3164Time(s string, loc *time.Location) (time.Time, bool) {
+	if len(s) < len(rfc3164Layout) {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(rfc3164Layout, s[:len(rfc3164Layout)], loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	now := time.Now()
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t, true
+}
+
+// parseRFC3164: "Mmm dd hh:mm:ss HOSTNAME TAG: MSG"，HOSTNAME 可省略
+func parseRFC3164(s string, loc *time.Location) (host string, ts time.Time, body string) {
+	if len(s) < len(rfc3164Layout)+1 {
+		return "", time.Time{}, s
+	}
+	ts, ok := parseRFC3164Time(s, loc)
+	if !ok {
+		return "", time.Time{}, s
+	}
+
+	rest := strings.TrimPrefix(s[len(rfc3164Layout):], " ")
+	token, after, _ := strings.Cut(rest, " ")
+	if !strings.HasSuffix(token, ":") {
+		host = token
+		rest = after
+		token, after, _ = strings.Cut(rest, " ")
+	}
+	// 去掉 TAG（如 "mosdns:" 或 "mosdns[123]:"）
+	if strings.HasSuffix(token, ":") {
+		rest = after
+	}
+	return host, ts, rest
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"mosdns-log/config"
+)
+
+func TestReadSyslogFrame(t *testing.T) {
+	long := strings.Repeat("a", syslogMaxMessage+1)
+	cases := []struct {
+		name  string
+		input string
+		want  string
+		err   error
+	}{
+		{"newline", "<13>1 - host app - - - hello\nnext", "<13>1 - host app - - - hello\n", nil},
+		{"octet counting", "5 hello6 world", "hello", nil},
+		{"newline too long", long, "", errSyslogFrameTooLong},
+		{"length too long", strings.Repeat("9", syslogMaxMessage+1), "", errSyslogFrameTooLong},
+		{"partial line at EOF", "tail", "tail", io.EOF},
+	}
+	for _, tc := range cases {
+		r := bufio.NewReaderSize(strings.NewReader(tc.input), syslogMaxMessage)
+		got, err := readSyslogFrame(r)
+		if got != tc.want || !errors.Is(err, tc.err) {
+			t.Errorf("%s: readSyslogFrame = %.40q, %v; want %.40q, %v", tc.name, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+// 有状态的解析器按发送主机分开，一台主机的查询不会与另一台主机的应答配对
+func TestSyslogParserPerHost(t *testing.T) {
+	r, err := newSyslogReceiver(config.SyslogConfig{Format: FormatDnsmasq})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := r.parserFor("router-a"), r.parserFor("router-b")
+	if a == b || r.parserFor("router-a") != a {
+		t.Fatal("want one parser per host")
+	}
+
+	if _, err := a.Parse("query[A] example.com from 192.168.1.2"); err != nil {
+		t.Fatal(err)
+	}
+	if ql, _ := b.Parse("reply example.com is 1.2.3.4"); ql != nil {
+		t.Errorf("reply from router-b paired with query from router-a: %+v", ql)
+	}
+	if ql, _ := a.Parse("reply example.com is 1.2.3.4"); ql == nil || ql.ClientIP != "192.168.1.2" {
+		t.Errorf("router-a reply = %+v, want client 192.168.1.2", ql)
+	}
+
+	shared, err := newSyslogReceiver(config.SyslogConfig{Format: FormatMosdnsX})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared.parserFor("router-a") != shared.parserFor("router-b") {
+		t.Error("stateless parser should be shared")
+	}
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// utcTimeSQL 把按写入时的时区偏移保存的 time 文本换算为 UTC（精确到秒），
+// 不同偏移写入的记录按它比较才一致；SetupTimeIndex 为它建立表达式索引
+const utcTimeSQL = "datetime(time)"
+
+// SetupTimeIndex 为 query_logs 的 UTC 时间建立表达式索引，按时间窗口筛选时无需放宽范围或扫描全表
+func SetupTimeIndex(db *gorm.DB) error {
+	return db.Exec("CREATE INDEX IF NOT EXISTS idx_query_logs_utc_time ON query_logs(" + utcTimeSQL + ")").Error
+}
+
+// 特殊的时间格式名，与 zap 的 TimeEncoder 名称保持一致；其他值按 Go 时间格式解析
+const (
+	TimeEpoch       = "epoch"       // 秒，可带小数
+	TimeEpochMillis = "millis"      // 毫秒
+	TimeEpochNanos  = "nanos"       // 纳秒
+	TimeRFC3339     = "rfc3339"     // time.RFC3339
+	TimeRFC3339Nano = "rfc3339nano" // time.RFC3339Nano
+	TimeISO8601     = "iso8601"     // zap 的 ISO8601：2006-01-02T15:04:05.000Z0700
+)
+
+// defaultTimeLayouts 未配置 time_layouts 时依次尝试的格式
+var defaultTimeLayouts = []string{timeLayout, time.RFC3339Nano}
+
+// defaultTimeParser 使用默认格式与本地时区，用于推送接口中的原始日志行
+var defaultTimeParser = &TimeParser{layouts: defaultTimeLayouts, epoch: time.Second, loc: time.Local}
+
+// TimeParser 按配置的格式依次尝试解析时间戳，不带时区的时间戳按 loc 解释
+type TimeParser struct {
+	layouts []string
+	epoch   time.Duration // 数值时间戳的单位，取第一个 epoch 类格式，默认秒
+	loc     *time.Location
+}
+
+// NewTimeParser 创建时间解析器；layouts 为空时使用 mosdns 默认格式，tz 为空时使用本地时区
+func NewTimeParser(layouts []string, tz string) (*TimeParser, error) {
+	tp := &TimeParser{epoch: time.Second, loc: time.Local}
+	if tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %w", tz, err)
+		}
+		tp.loc = loc
+	}
+
+	if len(layouts) == 0 {
+		layouts = defaultTimeLayouts
+	}
+	epochSet := false
+	for _, l := range layouts {
+		switch strings.ToLower(l) {
+		case TimeEpoch, TimeEpochMillis, TimeEpochNanos:
+			l = strings.ToLower(l)
+			if !epochSet {
+				tp.epoch = epochUnit(l)
+				epochSet = true
+			}
+		case TimeRFC3339:
+			l = time.RFC3339
+		case TimeRFC3339Nano:
+			l = time.RFC3339Nano
+		case TimeISO8601:
+			l = "2006-01-02T15:04:05.000Z0700"
+		case "":
+			return nil, fmt.Errorf("empty time layout")
+		}
+		tp.layouts = append(tp.layouts, l)
+	}
+	return tp, nil
+}
+
+func epochUnit(name string) time.Duration {
+	switch name {
+	case TimeEpochMillis:
+		return time.Millisecond
+	case TimeEpochNanos:
+		return time.Nanosecond
+	}
+	return time.Second
+}
+
+// Parse 解析一个时间戳字符串
+func (tp *TimeParser) Parse(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, false
+	}
+	for _, l := range tp.layouts {
+		switch l {
+		case TimeEpoch, TimeEpochMillis, TimeEpochNanos:
+			if t, ok := parseEpoch(s, epochUnit(l)); ok {
+				return t, true
+			}
+		default:
+			if t, err := time.ParseInLocation(l, s, tp.loc); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// ParseEpoch 解析 JSON 中的数值时间戳，单位取第一个 epoch 类格式
+func (tp *TimeParser) ParseEpoch(s string) (time.Time, bool) {
+	return parseEpoch(s, tp.epoch)
+}
+
+// Location 返回不带时区的时间戳所使用的时区
+func (tp *TimeParser) Location() *time.Location {
+	return tp.loc
+}
+
+// parseEpoch 解析整数或小数形式的时间戳，整数部分按整数运算以免丢失精度
+func parseEpoch(s string, unit time.Duration) (time.Time, bool) {
+	intPart, frac, _ := strings.Cut(s, ".")
+	n, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	var fracNs int64
+	if frac != "" {
+		f, err := strconv.ParseFloat("0."+frac, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		fracNs = int64(f * float64(unit))
+	}
+	return time.Unix(0, n*int64(unit)+fracNs), true
+}
+
+// parsePrefix 解析行首的时间戳。zap 控制台格式以制表符分隔字段，
+// 没有制表符时依次尝试第一个、前两个空格分隔的字段（格式本身可能含空格）。
+func (tp *TimeParser) parsePrefix(line string) (time.Time, bool) {
+	if idx := strings.IndexByte(line, '\t'); idx > 0 {
+		return tp.Parse(line[:idx])
+	}
+	idx := strings.IndexByte(line, ' ')
+	if idx <= 0 {
+		return time.Time{}, false
+	}
+	if t, ok := tp.Parse(line[:idx]); ok {
+		return t, true
+	}
+	if next := strings.IndexByte(line[idx+1:], ' '); next > 0 {
+		return tp.Parse(line[:idx+1+next])
+	}
+	return time.Time{}, false
+}
+
+// parseJSON 解析 zap 的 ts 字段：数值按 epoch 单位解析，字符串按配置的格式解析
+func (tp *TimeParser) parseJSON(raw []byte) time.Time {
+	s := strings.TrimSpace(string(raw))
+	if s == "" {
+		return time.Time{}
+	}
+	if unq, err := strconv.Unquote(s); err == nil {
+		t, _ := tp.Parse(unq)
+		return t
+	}
+	t, _ := tp.ParseEpoch(s)
+	return t
+}
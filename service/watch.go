@@ -0,0 +1,76 @@
+package service
+
+import (
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// pollInterval 无法使用 inotify 时 EOF 后的轮询间隔
+	pollInterval = 500 * time.Millisecond
+	// watchFlushDelay 有待发送数据时，等待新事件的最长时间
+	watchFlushDelay = 100 * time.Millisecond
+	// watchIdleTimeout 空闲时的兜底检查间隔，防止遗漏事件
+	watchIdleTimeout = 5 * time.Second
+)
+
+// watchFile 通过 inotify 监听日志文件所在目录，文件被写入、截断、改名、创建或删除时
+// 向返回的通道发送通知。不可用时返回 nil，调用方回退到轮询。
+func (c *Collector) watchFile(path string) <-chan struct{} {
+	target, err := filepath.Abs(path)
+	if err != nil {
+		target = filepath.Clean(path)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Warn("inotify unavailable, falling back to polling", "path", path, "error", err)
+		return nil
+	}
+	// 监听目录而非文件本身，以便在改名轮转后仍能收到新文件的事件
+	if err := watcher.Add(filepath.Dir(target)); err != nil {
+		watcher.Close()
+		slog.Warn("Failed to watch log directory, falling back to polling", "path", path, "error", err)
+		return nil
+	}
+
+	notify := make(chan struct{}, 1)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer watcher.Close()
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) != target {
+					continue
+				}
+				select {
+				case notify <- struct{}{}:
+				default:
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				// 队列溢出等错误时唤醒一次，由调用方重新检查文件状态
+				slog.Warn("inotify watcher error", "path", path, "error", err)
+				select {
+				case notify <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	slog.Info("Watching log file with inotify", "path", path)
+	return notify
+}
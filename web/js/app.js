@@ -45,6 +45,7 @@ document.addEventListener('DOMContentLoaded', () => {
         page: 1,
         pageSize: 50,
         search: '',
+        source: '',
         filters: {
             startTime: '',
             endTime: '',
@@ -64,6 +65,9 @@ document.addEventListener('DOMContentLoaded', () => {
         upLat7d: document.getElementById('up-lat-7d'),
 
         logsBody: document.getElementById('logs-body'),
+        collectorStatus: document.getElementById('collector-status'),
+        collectorStatusText: document.getElementById('collector-status-text'),
+        sourceFilter: document.getElementById('source-filter'),
 
         prevBtn: document.getElementById('prev-page'),
         nextBtn: document.getElementById('next-page'),
@@ -92,9 +96,57 @@ document.addEventListener('DOMContentLoaded', () => {
     };
 
     // --- API Interactions ---
+    // Scope a request to the selected mosdns instance (empty = all instances)
+    const withSource = (url) => {
+        if (!state.source) return url;
+        const sep = url.includes('?') ? '&' : '?';
+        return `${url}${sep}source=${encodeURIComponent(state.source)}`;
+    };
+
+    async function fetchSources() {
+        try {
+            const res = await fetch('/api/sources');
+            const sources = await res.json();
+            const select = elements.sourceFilter;
+            if (!select) return;
+            select.innerHTML = '<option value="">所有实例</option>';
+            (sources || []).forEach(name => {
+                const opt = document.createElement('option');
+                opt.value = name;
+                opt.textContent = name;
+                if (name === state.source) opt.selected = true;
+                select.appendChild(opt);
+            });
+        } catch (e) {
+            console.error('Failed to fetch sources', e);
+        }
+    }
+
+    async function fetchCollectorStatus() {
+        if (!elements.collectorStatus) return;
+        try {
+            const res = await fetch('/api/collector/status');
+            const s = await res.json();
+            const lagging = s.status !== 'healthy';
+            elements.collectorStatus.classList.toggle('offline', lagging);
+            if (!lagging) {
+                elements.collectorStatusText.textContent = '采集正常';
+            } else if (s.lag_seconds > 0) {
+                elements.collectorStatusText.textContent = `采集落后 ${Math.round(s.lag_seconds)} 秒`;
+            } else {
+                elements.collectorStatusText.textContent = s.spool_pending ? '数据库写入积压' : '采集队列积压';
+            }
+            elements.collectorStatus.title = `已读取 ${s.lines_read} 行，已入库 ${s.rows_inserted} 条，队列 ${s.batch_queue}/${s.batch_queue_cap}，最近写入耗时 ${s.last_insert_latency_ms.toFixed(1)}ms`;
+        } catch (e) {
+            elements.collectorStatus.classList.add('offline');
+            elements.collectorStatusText.textContent = '无法连接';
+            console.error('Failed to fetch collector status', e);
+        }
+    }
+
     async function fetchStats() {
         try {
-            const res = await fetch('/api/stats');
+            const res = await fetch(withSource('/api/stats'));
             const data = await res.json();
             state.stats = data;
             updateStatsUI();
@@ -105,7 +157,7 @@ document.addEventListener('DOMContentLoaded', () => {
 
     async function fetchClients() {
         try {
-            const res = await fetch('/api/clients');
+            const res = await fetch(withSource('/api/clients'));
             const clients = await res.json();
 
             const populate = (select, current) => {
@@ -133,7 +185,7 @@ document.addEventListener('DOMContentLoaded', () => {
 
     async function fetchQTypes() {
         try {
-            const res = await fetch('/api/qtypes');
+            const res = await fetch(withSource('/api/qtypes'));
             const types = await res.json();
 
             const populate = (select, current) => {
@@ -160,7 +212,7 @@ document.addEventListener('DOMContentLoaded', () => {
 
     async function fetchRCodes() {
         try {
-            const res = await fetch('/api/rcodes');
+            const res = await fetch(withSource('/api/rcodes'));
             const data = await res.json();
 
             const populate = (select, current) => {
@@ -200,6 +252,7 @@ document.addEventListener('DOMContentLoaded', () => {
         if (state.filters.type) params.append('type', state.filters.type);
         if (state.filters.rCode) params.append('r_code', state.filters.rCode);
         if (state.filters.clientIp) params.append('client_ip', state.filters.clientIp);
+        if (state.source) params.append('source', state.source);
 
         if (state.logs.length === 0 && elements.logsBody) {
             elements.logsBody.innerHTML = '<tr><td colspan="6" style="text-align:center; padding: 20px; color: #718096;">正在加载日志...</td></tr>';
@@ -298,6 +351,7 @@ document.addEventListener('DOMContentLoaded', () => {
         elements.logsBody.innerHTML = state.logs.map(log => {
             const date = new Date(log.time);
             const timeStr = date.toLocaleString('zh-CN');
+            const timeTitle = log.time_estimated ? ' title="日志中没有可解析的时间戳，显示的是采集时间"' : '';
 
             let latencyStr = '';
             let latencyClass = '';
@@ -322,11 +376,17 @@ document.addEventListener('DOMContentLoaded', () => {
                 }
             }
 
+            // Answer records (if the source provides them) as a tooltip on the domain
+            const answersTitle = (log.answers || [])
+                .map(a => `${getQTypeName(a.type)} ${a.data}`)
+                .join('\n')
+                .replace(/"/g, '&quot;');
+
             return `
                 <tr>
-                    <td class="col-time" data-label="时间">${timeStr}</td>
+                    <td class="col-time" data-label="时间"${timeTitle}>${log.time_estimated ? '≈ ' : ''}${timeStr}</td>
                     <td class="col-ip" data-label="客户端 IP"><span class="clickable-ip" onclick="window.filterByIP('${log.client_ip}')" title="点击筛选 IP">${log.client_ip}</span></td>
-                    <td class="col-domain" data-label="域名">${log.q_name}</td>
+                    <td class="col-domain" data-label="域名" title="${answersTitle}">${log.q_name}</td>
                     <td class="col-type" data-label="类型">${getQTypeName(log.q_type)}</td>
                     <td class="col-rcode" data-label="RCode">${getRCodeName(log.r_code)}</td>
                     <td class="col-latency ${latencyClass}" data-label="耗时">${latencyStr}</td>
@@ -383,8 +443,21 @@ document.addEventListener('DOMContentLoaded', () => {
         });
     }
 
+    if (elements.sourceFilter) {
+        elements.sourceFilter.addEventListener('change', (e) => {
+            state.source = e.target.value;
+            state.page = 1;
+            fetchStats();
+            fetchClients();
+            fetchQTypes();
+            fetchRCodes();
+            fetchLogs();
+        });
+    }
+
     if (elements.refreshBtn) {
         elements.refreshBtn.addEventListener('click', () => {
+            fetchSources();
             fetchStats();
             fetchClients();
             fetchQTypes();
@@ -437,6 +510,9 @@ document.addEventListener('DOMContentLoaded', () => {
     }
 
     // Init
+    fetchCollectorStatus();
+    setInterval(fetchCollectorStatus, 10000);
+    fetchSources();
     fetchStats();
     fetchClients();
     fetchQTypes();